@@ -3,7 +3,6 @@ resource "bluechi_node" "main" {
   ssh = {
     host                     = "127.0.0.1:2020"
     user                     = "root"
-    password                 = ""
     private_key_path         = "~/.ssh/id_rsa"
     accept_host_key_insecure = true
   }
@@ -22,7 +21,6 @@ resource "bluechi_node" "main" {
     node_name          = "main"
     manager_host       = "127.0.0.1"
     manager_port       = 3030
-    manager_address    = ""
     heartbeat_interval = 5000
     log_level          = "DEBUG"
     log_target         = "stderr-full"
@@ -35,7 +33,6 @@ resource "bluechi_node" "worker1" {
   ssh = {
     host                     = "127.0.0.1:2021"
     user                     = "root"
-    password                 = ""
     private_key_path         = "~/.ssh/id_rsa"
     accept_host_key_insecure = true
   }
@@ -44,7 +41,6 @@ resource "bluechi_node" "worker1" {
     node_name          = "worker1"
     manager_host       = "127.0.0.1"
     manager_port       = 3030
-    manager_address    = ""
     heartbeat_interval = 5000
     log_level          = "DEBUG"
     log_target         = "stderr-full"
@@ -57,7 +53,6 @@ resource "bluechi_node" "worker2" {
   ssh = {
     host                     = "127.0.0.1:2022"
     user                     = "root"
-    password                 = ""
     private_key_path         = "~/.ssh/id_rsa"
     accept_host_key_insecure = true
   }
@@ -66,7 +61,6 @@ resource "bluechi_node" "worker2" {
     node_name          = "worker2"
     manager_host       = "127.0.0.1"
     manager_port       = 3030
-    manager_address    = ""
     heartbeat_interval = 5000
     log_level          = "DEBUG"
     log_target         = "stderr-full"
@@ -79,7 +73,6 @@ resource "bluechi_node" "worker3" {
   ssh = {
     host                     = "127.0.0.1:2023"
     user                     = "root"
-    password                 = ""
     private_key_path         = "~/.ssh/id_rsa"
     accept_host_key_insecure = true
   }
@@ -88,7 +81,6 @@ resource "bluechi_node" "worker3" {
     node_name          = "worker3"
     manager_host       = "127.0.0.1"
     manager_port       = 3030
-    manager_address    = ""
     heartbeat_interval = 5000
     log_level          = "DEBUG"
     log_target         = "stderr-full"
@@ -5,7 +5,6 @@ resource "bluechi_node" "main" {
   ssh = {
     host                     = "${aws_instance.ec2main.*.public_ip[0]}:22"
     user                     = var.ssh_user
-    password                 = ""
     private_key_path         = var.ssh_key_pair[1]
     accept_host_key_insecure = true
   }
@@ -24,7 +23,6 @@ resource "bluechi_node" "main" {
     node_name          = var.bluechi_nodes[0]
     manager_host       = "127.0.0.1"
     manager_port       = var.bluechi_manager_port
-    manager_address    = ""
     heartbeat_interval = 5000
     log_level          = "DEBUG"
     log_target         = "stderr-full"
@@ -39,7 +37,6 @@ resource "bluechi_node" "worker1" {
   ssh = {
     host                     = "${aws_instance.ec2worker1.*.public_ip[0]}:22"
     user                     = var.ssh_user
-    password                 = ""
     private_key_path         = var.ssh_key_pair[1]
     accept_host_key_insecure = true
   }
@@ -48,7 +45,6 @@ resource "bluechi_node" "worker1" {
     node_name          = var.bluechi_nodes[1]
     manager_host       = "${aws_instance.ec2main.*.private_ip[0]}"
     manager_port       = var.bluechi_manager_port
-    manager_address    = ""
     heartbeat_interval = 5000
     log_level          = "DEBUG"
     log_target         = "stderr-full"
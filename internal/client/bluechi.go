@@ -1,6 +1,7 @@
 package client
 
 import (
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -8,67 +9,241 @@ import (
 const (
 	BlueChiControllerConfdDirectory string = "/etc/bluechi/controller.conf.d/"
 	BlueChiAgentConfdDirectory      string = "/etc/bluechi/agent.conf.d/"
-)
 
-type BlueChiControllerConfig struct {
-	AllowedNodeNames []string
-	ManagerPort      *int64
-	LogLevel         *string
-	LogTarget        *string
-	LogIsQuiet       *bool
-}
+	BlueChiControllerService string = "bluechi-controller.service"
+	BlueChiAgentService      string = "bluechi-agent.service"
 
-func (cfg BlueChiControllerConfig) Serialize() string {
-	res := "[bluechi-controller]\n"
-	res += "AllowedNodeNames=" + strings.Join(cfg.AllowedNodeNames, ",\n\t")
-	res += "\n"
-	if cfg.ManagerPort != nil {
-		res += "ManagerPort=" + strconv.FormatInt(*cfg.ManagerPort, 10) + "\n"
+	// ManagedConfigMarker starts the first line of every config file written
+	// by the provider, followed by the id of the owning resource.
+	ManagedConfigMarker string = "# Managed by terraform-provider-bluechi, node "
+
+	// backupSuffix is appended to the name of backed up files. BlueChi only
+	// loads drop-ins with the .conf suffix, so backups are ignored.
+	backupSuffix string = ".tf-backup"
+	// preservedSuffix is appended to the name of files which existed before
+	// the provider wrote its config to the same path.
+	preservedSuffix string = ".tf-original"
+)
+
+var (
+	// ControllerConfigKeys and AgentConfigKeys are the keys modelled by the
+	// config structs, which therefore can't be passed as extra options.
+	ControllerConfigKeys = []string{
+		"AllowedNodeNames", "ManagerPort", "ControllerPort", "ControllerUseTCP", "ControllerUseUDS",
+		"HeartbeatInterval", "NodeHeartbeatThreshold", "TCPKeepAliveTime", "TCPKeepAliveInterval",
+		"TCPKeepAliveCount", "IPReceiveErrors", "LogLevel", "LogTarget", "LogIsQuiet",
 	}
-	if cfg.LogLevel != nil {
-		res += "LogLevel=" + *cfg.LogLevel + "\n"
+	AgentConfigKeys = []string{
+		"NodeName", "ManagerHost", "ManagerPort", "ManagerAddress", "ControllerHost", "ControllerPort",
+		"ControllerAddress", "HeartbeatInterval", "ControllerHeartbeatThreshold", "ConnectionRetryCount",
+		"ConnectionRetryCountUntilQuiet", "TCPKeepAliveTime", "TCPKeepAliveInterval", "TCPKeepAliveCount",
+		"IPReceiveErrors", "LogLevel", "LogTarget", "LogIsQuiet",
 	}
-	if cfg.LogTarget != nil {
-		res += "LogTarget=" + *cfg.LogTarget + "\n"
+)
+
+type ServiceStatus struct {
+	Enabled bool
+	Active  bool
+}
+
+type configEntry struct {
+	Key   string
+	Value string
+}
+
+func appendString(entries []configEntry, key string, value *string) []configEntry {
+	if value == nil {
+		return entries
 	}
-	if cfg.LogIsQuiet != nil {
-		res += "LogIsQuiet=" + strconv.FormatBool(*cfg.LogIsQuiet) + "\n"
+	return append(entries, configEntry{Key: key, Value: *value})
+}
+
+func appendInt(entries []configEntry, key string, value *int64) []configEntry {
+	if value == nil {
+		return entries
 	}
+	return append(entries, configEntry{Key: key, Value: strconv.FormatInt(*value, 10)})
+}
 
-	return res
+func appendBool(entries []configEntry, key string, value *bool) []configEntry {
+	if value == nil {
+		return entries
+	}
+	return append(entries, configEntry{Key: key, Value: strconv.FormatBool(*value)})
 }
 
-type BlueChiAgentConfig struct {
-	NodeName          *string
-	ManagerHost       *string
-	ManagerPort       *int64
-	ManagerAddress    *string
-	HeartbeatInterval *int64
-	LogLevel          *string
-	LogTarget         *string
-	LogIsQuiet        *bool
+func appendExtraOptions(entries []configEntry, options map[string]string) []configEntry {
+	keys := []string{}
+	for key := range options {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		entries = append(entries, configEntry{Key: key, Value: options[key]})
+	}
+	return entries
 }
 
-func (cfg BlueChiAgentConfig) Serialize() string {
-	res := "[bluechi-agent]\n"
-	res += "NodeName=" + *cfg.NodeName + "\n"
-	res += "ManagerHost=" + *cfg.ManagerHost + "\n"
-	res += "ManagerPort=" + strconv.FormatInt(*cfg.ManagerPort, 10) + "\n"
-	if cfg.ManagerAddress != nil {
-		res += "ManagerAddress=" + *cfg.ManagerAddress + "\n"
+func serializeSection(section string, owner string, entries []configEntry, version *BlueChiVersion) string {
+	res := ""
+	if owner != "" {
+		res += ManagedConfigMarker + owner + "\n"
 	}
-	if cfg.HeartbeatInterval != nil {
-		res += "HeartbeatInterval=" + strconv.FormatInt(*cfg.HeartbeatInterval, 10) + "\n"
+	res += "[" + section + "]\n"
+	for _, entry := range entries {
+		res += keyName(entry.Key, version) + "=" + entry.Value + "\n"
 	}
-	if cfg.LogLevel != nil {
-		res += "LogLevel=" + *cfg.LogLevel + "\n"
+	return res
+}
+
+func entryValues(entries []configEntry, version *BlueChiVersion) map[string]string {
+	values := map[string]string{}
+	for _, entry := range entries {
+		values[keyName(entry.Key, version)] = joinContinuationLines(entry.Value)
 	}
-	if cfg.LogTarget != nil {
-		res += "LogTarget=" + *cfg.LogTarget + "\n"
+	return values
+}
+
+func entryKeys(entries []configEntry) []string {
+	keys := []string{}
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
 	}
-	if cfg.LogIsQuiet != nil {
-		res += "LogIsQuiet=" + strconv.FormatBool(*cfg.LogIsQuiet) + "\n"
+	return keys
+}
+
+type BlueChiControllerConfig struct {
+	AllowedNodeNames       []string
+	ManagerPort            *int64
+	ControllerPort         *int64
+	ControllerUseTCP       *bool
+	ControllerUseUDS       *bool
+	HeartbeatInterval      *int64
+	NodeHeartbeatThreshold *int64
+	TCPKeepAliveTime       *int64
+	TCPKeepAliveInterval   *int64
+	TCPKeepAliveCount      *int64
+	IPReceiveErrors        *bool
+	LogLevel               *string
+	LogTarget              *string
+	LogIsQuiet             *bool
+
+	// ExtraOptions are additional keys not modelled above which are added
+	// to the section as is.
+	ExtraOptions map[string]string
+
+	// Version of BlueChi on the node the config is rendered for. If not set,
+	// the keys are rendered as configured.
+	Version *BlueChiVersion
+	// Owner is the id of the resource managing the config file
+	Owner string
+}
+
+func (cfg BlueChiControllerConfig) entries() []configEntry {
+	entries := []configEntry{
+		{Key: "AllowedNodeNames", Value: strings.Join(cfg.AllowedNodeNames, ",\n\t")},
 	}
+	entries = appendInt(entries, "ManagerPort", cfg.ManagerPort)
+	entries = appendInt(entries, "ControllerPort", cfg.ControllerPort)
+	entries = appendBool(entries, "ControllerUseTCP", cfg.ControllerUseTCP)
+	entries = appendBool(entries, "ControllerUseUDS", cfg.ControllerUseUDS)
+	entries = appendInt(entries, "HeartbeatInterval", cfg.HeartbeatInterval)
+	entries = appendInt(entries, "NodeHeartbeatThreshold", cfg.NodeHeartbeatThreshold)
+	entries = appendInt(entries, "TCPKeepAliveTime", cfg.TCPKeepAliveTime)
+	entries = appendInt(entries, "TCPKeepAliveInterval", cfg.TCPKeepAliveInterval)
+	entries = appendInt(entries, "TCPKeepAliveCount", cfg.TCPKeepAliveCount)
+	entries = appendBool(entries, "IPReceiveErrors", cfg.IPReceiveErrors)
+	entries = appendString(entries, "LogLevel", cfg.LogLevel)
+	entries = appendString(entries, "LogTarget", cfg.LogTarget)
+	entries = appendBool(entries, "LogIsQuiet", cfg.LogIsQuiet)
+	entries = appendExtraOptions(entries, cfg.ExtraOptions)
 
-	return res
+	return entries
+}
+
+// Values returns the keys and values as read back from the config file
+func (cfg BlueChiControllerConfig) Values() map[string]string {
+	return entryValues(cfg.entries(), cfg.Version)
+}
+
+func (cfg BlueChiControllerConfig) Serialize() string {
+	return serializeSection("bluechi-controller", cfg.Owner, cfg.entries(), cfg.Version)
+}
+
+// UnsupportedKeys returns the configured keys which are not supported by
+// the BlueChi version the config is rendered for.
+func (cfg BlueChiControllerConfig) UnsupportedKeys() []string {
+	return unsupportedKeys(entryKeys(cfg.entries()), controllerKeysIntroducedIn, cfg.Version)
+}
+
+type BlueChiAgentConfig struct {
+	NodeName                       *string
+	ManagerHost                    *string
+	ManagerPort                    *int64
+	ManagerAddress                 *string
+	ControllerHost                 *string
+	ControllerPort                 *int64
+	ControllerAddress              *string
+	HeartbeatInterval              *int64
+	ControllerHeartbeatThreshold   *int64
+	ConnectionRetryCount           *int64
+	ConnectionRetryCountUntilQuiet *int64
+	TCPKeepAliveTime               *int64
+	TCPKeepAliveInterval           *int64
+	TCPKeepAliveCount              *int64
+	IPReceiveErrors                *bool
+	LogLevel                       *string
+	LogTarget                      *string
+	LogIsQuiet                     *bool
+
+	// ExtraOptions are additional keys not modelled above which are added
+	// to the section as is.
+	ExtraOptions map[string]string
+
+	// Version of BlueChi on the node the config is rendered for. If not set,
+	// the keys are rendered as configured.
+	Version *BlueChiVersion
+	// Owner is the id of the resource managing the config file
+	Owner string
+}
+
+func (cfg BlueChiAgentConfig) entries() []configEntry {
+	entries := []configEntry{}
+	entries = appendString(entries, "NodeName", cfg.NodeName)
+	entries = appendString(entries, "ManagerHost", cfg.ManagerHost)
+	entries = appendInt(entries, "ManagerPort", cfg.ManagerPort)
+	entries = appendString(entries, "ManagerAddress", cfg.ManagerAddress)
+	entries = appendString(entries, "ControllerHost", cfg.ControllerHost)
+	entries = appendInt(entries, "ControllerPort", cfg.ControllerPort)
+	entries = appendString(entries, "ControllerAddress", cfg.ControllerAddress)
+	entries = appendInt(entries, "HeartbeatInterval", cfg.HeartbeatInterval)
+	entries = appendInt(entries, "ControllerHeartbeatThreshold", cfg.ControllerHeartbeatThreshold)
+	entries = appendInt(entries, "ConnectionRetryCount", cfg.ConnectionRetryCount)
+	entries = appendInt(entries, "ConnectionRetryCountUntilQuiet", cfg.ConnectionRetryCountUntilQuiet)
+	entries = appendInt(entries, "TCPKeepAliveTime", cfg.TCPKeepAliveTime)
+	entries = appendInt(entries, "TCPKeepAliveInterval", cfg.TCPKeepAliveInterval)
+	entries = appendInt(entries, "TCPKeepAliveCount", cfg.TCPKeepAliveCount)
+	entries = appendBool(entries, "IPReceiveErrors", cfg.IPReceiveErrors)
+	entries = appendString(entries, "LogLevel", cfg.LogLevel)
+	entries = appendString(entries, "LogTarget", cfg.LogTarget)
+	entries = appendBool(entries, "LogIsQuiet", cfg.LogIsQuiet)
+	entries = appendExtraOptions(entries, cfg.ExtraOptions)
+
+	return entries
+}
+
+// Values returns the keys and values as read back from the config file
+func (cfg BlueChiAgentConfig) Values() map[string]string {
+	return entryValues(cfg.entries(), cfg.Version)
+}
+
+func (cfg BlueChiAgentConfig) Serialize() string {
+	return serializeSection("bluechi-agent", cfg.Owner, cfg.entries(), cfg.Version)
+}
+
+// UnsupportedKeys returns the configured keys which are not supported by
+// the BlueChi version the config is rendered for.
+func (cfg BlueChiAgentConfig) UnsupportedKeys() []string {
+	return unsupportedKeys(entryKeys(cfg.entries()), agentKeysIntroducedIn, cfg.Version)
 }
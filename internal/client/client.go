@@ -1,18 +1,43 @@
 package client
 
+import "time"
+
 type Client interface {
 	Connect() error
 	Disconnect() error
 
-	InstallBlueChi(bool, bool) error
+	BackupFile(string) (bool, error)
+	RestoreFile(string) error
+	RemoveBackup(string) error
+	PreserveFile(string) (string, error)
+	RestorePreservedFile(string, string) error
+
+	InstallBlueChi(InstallConfig) ([]string, error)
+	UninstallPackages([]string) error
+	GetPackageVersions([]string) (map[string]string, error)
+	GetBlueChiVersion() (*BlueChiVersion, error)
+	ConfigurePackageSource(PackageSourceConfig) (ManagedPackageSource, error)
+	RemovePackageSource(ManagedPackageSource) error
+
+	SetServiceEnabled(string, bool) error
+	GetServiceStatus(string) (ServiceStatus, error)
+	CreateServiceOverrides(string, ServiceOverrides) (bool, error)
+	RemoveServiceOverrides(string) error
+	WaitForControllerOnline(int64, time.Duration) error
+	WaitForAgentOnline(time.Duration) error
+
+	ListManagedConfigs(string) (map[string]string, error)
+	GetEffectiveConfig(string, string) (EffectiveConfig, error)
 
-	CreateControllerConfig(string, BlueChiControllerConfig) error
+	CreateControllerConfig(string, BlueChiControllerConfig) (bool, error)
 	RemoveControllerConfig(string) error
 	RestartBlueChiController() error
+	StartBlueChiController() error
 	StopBlueChiController() error
 
-	CreateAgentConfig(string, BlueChiAgentConfig) error
+	CreateAgentConfig(string, BlueChiAgentConfig) (bool, error)
 	RemoveAgentConfig(string) error
 	RestartBlueChiAgent() error
+	StartBlueChiAgent() error
 	StopBlueChiAgent() error
 }
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type BlueChiVersion struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// ErrInvalidBlueChiVersion is returned for versions which can't be parsed.
+var ErrInvalidBlueChiVersion = errors.New("invalid BlueChi version")
+
+// ParseBlueChiVersion parses versions like 0.8.0 or package versions like
+// 0.8.0-1.el9, 1:0.8.0-1 or 0.9.0^20240101git1234, ignoring the epoch and
+// everything after the numeric part.
+func ParseBlueChiVersion(version string) (BlueChiVersion, error) {
+	res := BlueChiVersion{}
+
+	withoutEpoch := version
+	if epoch, rest, found := strings.Cut(version, ":"); found {
+		if _, err := strconv.Atoi(epoch); err != nil {
+			return res, fmt.Errorf("%w '%s'", ErrInvalidBlueChiVersion, version)
+		}
+		withoutEpoch = rest
+	}
+
+	numeric := strings.FieldsFunc(withoutEpoch, func(r rune) bool {
+		return r == '-' || r == '~' || r == '+' || r == '^'
+	})
+	if len(numeric) == 0 {
+		return res, fmt.Errorf("%w '%s'", ErrInvalidBlueChiVersion, version)
+	}
+
+	parts := strings.Split(numeric[0], ".")
+	if len(parts) > 3 {
+		return res, fmt.Errorf("%w '%s'", ErrInvalidBlueChiVersion, version)
+	}
+	values := []*int{&res.Major, &res.Minor, &res.Patch}
+	for i, part := range parts {
+		value, err := strconv.Atoi(part)
+		if err != nil {
+			return res, fmt.Errorf("%w '%s'", ErrInvalidBlueChiVersion, version)
+		}
+		*values[i] = value
+	}
+
+	return res, nil
+}
+
+func (v BlueChiVersion) Less(other BlueChiVersion) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	return v.Patch < other.Patch
+}
+
+func (v BlueChiVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+var (
+	// ManagerKeysRenamedIn is the BlueChi version in which the Manager*
+	// keys have been renamed to Controller*.
+	ManagerKeysRenamedIn = BlueChiVersion{0, 7, 0}
+
+	renamedManagerKeys = map[string]string{
+		"ManagerHost":    "ControllerHost",
+		"ManagerPort":    "ControllerPort",
+		"ManagerAddress": "ControllerAddress",
+	}
+
+	// Versions in which configuration keys have been introduced. Keys not
+	// listed are supported by all versions.
+	controllerKeysIntroducedIn = map[string]BlueChiVersion{
+		"ControllerUseTCP":       {0, 9, 0},
+		"ControllerUseUDS":       {0, 9, 0},
+		"HeartbeatInterval":      {0, 8, 0},
+		"NodeHeartbeatThreshold": {0, 8, 0},
+		"TCPKeepAliveTime":       {0, 8, 0},
+		"TCPKeepAliveInterval":   {0, 8, 0},
+		"TCPKeepAliveCount":      {0, 8, 0},
+		"IPReceiveErrors":        {0, 8, 0},
+	}
+	agentKeysIntroducedIn = map[string]BlueChiVersion{
+		"ControllerHeartbeatThreshold":   {0, 8, 0},
+		"ConnectionRetryCount":           {0, 9, 0},
+		"ConnectionRetryCountUntilQuiet": {0, 9, 0},
+		"TCPKeepAliveTime":               {0, 8, 0},
+		"TCPKeepAliveInterval":           {0, 8, 0},
+		"TCPKeepAliveCount":              {0, 8, 0},
+		"IPReceiveErrors":                {0, 8, 0},
+	}
+)
+
+// keyName returns the name of the given key as understood by the given
+// BlueChi version. Without a version the key is used as is.
+func keyName(key string, version *BlueChiVersion) string {
+	if version == nil {
+		return key
+	}
+
+	for managerKey, controllerKey := range renamedManagerKeys {
+		if key != managerKey && key != controllerKey {
+			continue
+		}
+		if version.Less(ManagerKeysRenamedIn) {
+			return managerKey
+		}
+		return controllerKey
+	}
+
+	return key
+}
+
+func unsupportedKeys(keys []string, introducedIn map[string]BlueChiVersion, version *BlueChiVersion) []string {
+	unsupported := []string{}
+	if version == nil {
+		return unsupported
+	}
+
+	for _, key := range keys {
+		if since, ok := introducedIn[key]; ok && version.Less(since) {
+			unsupported = append(unsupported, key)
+		}
+	}
+	return unsupported
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParseBlueChiVersion(t *testing.T) {
+	valid := map[string]BlueChiVersion{
+		"0.8.0":                          {0, 8, 0},
+		"0.10":                           {0, 10, 0},
+		"0.8.0-1.el9":                    {0, 8, 0},
+		"0.9.0~rc1-1.fc40":               {0, 9, 0},
+		"1:0.9.0-1":                      {0, 9, 0},
+		"0.9.0^20240101git1a2b3c-1.fc40": {0, 9, 0},
+	}
+	for version, expected := range valid {
+		parsed, err := ParseBlueChiVersion(version)
+		if err != nil {
+			t.Errorf("expected '%s' to parse, got: %v", version, err)
+			continue
+		}
+		if parsed != expected {
+			t.Errorf("expected '%s' to parse to %s, got %s", version, expected, parsed)
+		}
+	}
+
+	for _, version := range []string{"", "bluechi", "0.8.0.1", "x:0.8.0", "0.eight.0"} {
+		if _, err := ParseBlueChiVersion(version); !errors.Is(err, ErrInvalidBlueChiVersion) {
+			t.Errorf("expected '%s' to be invalid, got: %v", version, err)
+		}
+	}
+}
+
+func TestKeyName(t *testing.T) {
+	old := BlueChiVersion{0, 6, 0}
+	current := BlueChiVersion{0, 9, 0}
+
+	tests := []struct {
+		key      string
+		version  *BlueChiVersion
+		expected string
+	}{
+		{"ControllerPort", nil, "ControllerPort"},
+		{"ManagerPort", nil, "ManagerPort"},
+		{"ControllerHost", &old, "ManagerHost"},
+		{"ManagerPort", &current, "ControllerPort"},
+		{"ControllerAddress", &ManagerKeysRenamedIn, "ControllerAddress"},
+		{"LogLevel", &old, "LogLevel"},
+	}
+	for _, test := range tests {
+		if name := keyName(test.key, test.version); name != test.expected {
+			t.Errorf("expected %s for %s at %v, got %s", test.expected, test.key, test.version, name)
+		}
+	}
+}
+
+func TestUnsupportedKeys(t *testing.T) {
+	keys := []string{"LogLevel", "HeartbeatInterval", "ControllerUseTCP"}
+
+	if unsupported := unsupportedKeys(keys, controllerKeysIntroducedIn, nil); len(unsupported) != 0 {
+		t.Errorf("expected no unsupported keys without a version, got %v", unsupported)
+	}
+
+	tests := map[BlueChiVersion][]string{
+		{0, 7, 0}: {"HeartbeatInterval", "ControllerUseTCP"},
+		{0, 8, 0}: {"ControllerUseTCP"},
+		{0, 9, 0}: {},
+	}
+	for version, expected := range tests {
+		if unsupported := unsupportedKeys(keys, controllerKeysIntroducedIn, &version); !slices.Equal(unsupported, expected) {
+			t.Errorf("expected unsupported keys %v at %s, got %v", expected, version, unsupported)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"slices"
+	"strings"
+)
+
+const (
+	BlueChiControllerConfigFile string = "/etc/bluechi/controller.conf"
+	BlueChiAgentConfigFile      string = "/etc/bluechi/agent.conf"
+
+	// configFileSeparator is printed before the content of each file when
+	// reading multiple config files in one command.
+	configFileSeparator string = "### bluechi-config-file "
+)
+
+// EffectiveConfig is the configuration BlueChi ends up with after merging
+// the main config file and all drop-ins in lexical order.
+type EffectiveConfig struct {
+	Values map[string]string
+	// Sources holds the file which set the value of each key last
+	Sources map[string]string
+}
+
+// OverriddenKeys returns the keys set in the given file which are overridden
+// by another file, mapped to the overriding file.
+func (cfg EffectiveConfig) OverriddenKeys(file string, keys []string) map[string]string {
+	overridden := map[string]string{}
+	for _, key := range keys {
+		if source, ok := cfg.Sources[key]; ok && source != file {
+			overridden[key] = source
+		}
+	}
+	return overridden
+}
+
+// mergeConfigFiles parses the files in the given order and merges their
+// key value pairs, later files overriding earlier ones.
+func mergeConfigFiles(files []string, contents map[string]string) EffectiveConfig {
+	cfg := EffectiveConfig{
+		Values:  map[string]string{},
+		Sources: map[string]string{},
+	}
+
+	for _, file := range files {
+		key := ""
+		for _, raw := range strings.Split(contents[file], "\n") {
+			line := strings.TrimSpace(raw)
+			// indented lines continue the value of the previous key, as
+			// written for lists like AllowedNodeNames
+			if key != "" && line != "" && isContinuationLine(raw) {
+				cfg.Values[key] += line
+				continue
+			}
+
+			key = ""
+			if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "[") {
+				continue
+			}
+			name, value, found := strings.Cut(line, "=")
+			if !found {
+				continue
+			}
+			key = strings.TrimSpace(name)
+			cfg.Values[key] = strings.TrimSpace(value)
+			cfg.Sources[key] = file
+		}
+	}
+
+	return cfg
+}
+
+func isContinuationLine(line string) bool {
+	return strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+}
+
+// joinContinuationLines returns a value spanning multiple lines as it is
+// read by mergeConfigFiles.
+func joinContinuationLines(value string) string {
+	lines := strings.Split(value, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.Join(lines, "")
+}
+
+// splitConfigFiles splits the output of reading multiple config files into
+// the file names, in the order they have been read, and their contents.
+func splitConfigFiles(output string) ([]string, map[string]string) {
+	files := []string{}
+	contents := map[string]string{}
+
+	current := ""
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, configFileSeparator) {
+			current = strings.TrimPrefix(line, configFileSeparator)
+			if !slices.Contains(files, current) {
+				files = append(files, current)
+			}
+			continue
+		}
+		if current == "" {
+			continue
+		}
+		contents[current] += line + "\n"
+	}
+
+	return files, contents
+}
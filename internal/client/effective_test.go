@@ -0,0 +1,80 @@
+package client
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestMergeConfigFilesSerialized(t *testing.T) {
+	logLevel := "DEBUG"
+	port := int64(842)
+	cfg := BlueChiControllerConfig{
+		AllowedNodeNames: []string{"main", "worker1", "worker2"},
+		ManagerPort:      &port,
+		LogLevel:         &logLevel,
+		Owner:            "127.0.0.1/main",
+	}
+
+	file := BlueChiControllerConfdDirectory + "ZZZ-ctrl.conf"
+	effective := mergeConfigFiles([]string{file}, map[string]string{file: cfg.Serialize()})
+
+	if !maps.Equal(effective.Values, cfg.Values()) {
+		t.Errorf("expected values %v, got %v", cfg.Values(), effective.Values)
+	}
+	if effective.Values["AllowedNodeNames"] != "main,worker1,worker2" {
+		t.Errorf("expected all allowed node names, got '%s'", effective.Values["AllowedNodeNames"])
+	}
+	if overridden := effective.OverriddenKeys(file, slices.Collect(maps.Keys(cfg.Values()))); len(overridden) != 0 {
+		t.Errorf("expected no overridden keys, got %v", overridden)
+	}
+}
+
+func TestMergeConfigFilesOverride(t *testing.T) {
+	files := []string{BlueChiControllerConfigFile, BlueChiControllerConfdDirectory + "50-ctrl.conf", BlueChiControllerConfdDirectory + "ZZZ-ctrl.conf"}
+	contents := map[string]string{
+		files[0]: "[bluechi-controller]\nAllowedNodeNames=main,\n\tworker1\nLogLevel=INFO\n",
+		files[1]: "[bluechi-controller]\n# LogLevel=ERROR\nLogLevel = WARN\n",
+		files[2]: "[bluechi-controller]\nAllowedNodeNames=main\n",
+	}
+
+	effective := mergeConfigFiles(files, contents)
+
+	expected := map[string]string{"AllowedNodeNames": "main", "LogLevel": "WARN"}
+	if !maps.Equal(effective.Values, expected) {
+		t.Errorf("expected values %v, got %v", expected, effective.Values)
+	}
+	expectedSources := map[string]string{"AllowedNodeNames": files[2], "LogLevel": files[1]}
+	if !maps.Equal(effective.Sources, expectedSources) {
+		t.Errorf("expected sources %v, got %v", expectedSources, effective.Sources)
+	}
+}
+
+func TestSplitConfigFiles(t *testing.T) {
+	nodeName := "worker1"
+	host := "127.0.0.1"
+	ctrl := BlueChiControllerConfig{AllowedNodeNames: []string{"main", "worker1"}}
+	agent := BlueChiAgentConfig{NodeName: &nodeName, ManagerHost: &host}
+
+	ctrlFile := BlueChiControllerConfdDirectory + "ZZZ-ctrl.conf"
+	agentFile := BlueChiAgentConfdDirectory + "ZZZ-agent.conf"
+	// each file is followed by an empty line, see GetEffectiveConfig
+	output := configFileSeparator + ctrlFile + "\n" + ctrl.Serialize() + "\n" +
+		configFileSeparator + agentFile + "\n" + agent.Serialize() + "\n"
+
+	files, contents := splitConfigFiles(output)
+
+	if !slices.Equal(files, []string{ctrlFile, agentFile}) {
+		t.Fatalf("expected files in read order, got %v", files)
+	}
+	if contents[ctrlFile] != ctrl.Serialize()+"\n" {
+		t.Errorf("unexpected content of %s: %q", ctrlFile, contents[ctrlFile])
+	}
+
+	effective := mergeConfigFiles(files, contents)
+	expected := ctrl.Values()
+	maps.Copy(expected, agent.Values())
+	if !maps.Equal(effective.Values, expected) {
+		t.Errorf("expected values %v, got %v", expected, effective.Values)
+	}
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	YumReposDirectory string = "/etc/yum.repos.d/"
+
+	// ImageModeVerify only checks that BlueChi is part of the image of an
+	// rpm-ostree or bootc based system, ImageModeLayer installs missing
+	// packages as layers and reboots into the new deployment.
+	ImageModeVerify string = "verify"
+	ImageModeLayer  string = "layer"
+
+	rebootPollInterval = 10 * time.Second
+)
+
+var (
+	ControllerPackages = []string{"bluechi-controller", "bluechi-ctl"}
+	AgentPackages      = []string{"bluechi-agent"}
+
+	// ComponentPackages are the optional BlueChi packages which can be
+	// installed in addition to the controller and agent.
+	ComponentPackages = []string{"bluechi-selinux", "python3-bluechi", "bluechi-is-online"}
+)
+
+type InstallConfig struct {
+	Controller bool
+	Agent      bool
+	Proxy      *string
+	Components []string
+	ImageMode  string
+	// RebootTimeout is the time to wait for the machine to come back after
+	// layering packages on an image based system.
+	RebootTimeout time.Duration
+	// LocalPackages are paths to RPM or DEB files on the local machine which
+	// are uploaded and installed instead of using the configured repositories.
+	LocalPackages []string
+}
+
+type OSInfo struct {
+	ID        string
+	VersionID string
+	// ImageMode is set for immutable rpm-ostree and bootc based systems
+	ImageMode bool
+}
+
+type PackageSourceConfig struct {
+	RepoFiles map[string]string
+	CoprRepos []string
+	GPGKeys   []string
+	Proxy     *string
+}
+
+// ManagedPackageSource holds the package sources that have been added by
+// the provider and therefore need to be removed again on destroy.
+type ManagedPackageSource struct {
+	RepoFiles []string
+	CoprRepos []string
+	GPGKeys   []string
+}
+
+func isDNFBased(os string) bool {
+	return os == "autosd" || os == "centos" || os == "fedora" || os == "rhel"
+}
+
+func isAPTBased(os string) bool {
+	return os == "debian" || os == "ubuntu"
+}
+
+// isCoprRepoListed checks if the repo is in the output of dnf copr list,
+// which lists repos as <hub>/<owner>/<project> and the projects of a group
+// as <hub>/group_<name>/<project>.
+func isCoprRepoListed(output string, repo string) bool {
+	if group, found := strings.CutPrefix(repo, "@"); found {
+		repo = "group_" + group
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if _, listed, found := strings.Cut(strings.TrimSpace(line), "/"); found && listed == repo {
+			return true
+		}
+	}
+	return false
+}
+
+func dnfProxyOption(proxy *string) string {
+	if proxy == nil || *proxy == "" {
+		return ""
+	}
+	return shellQuote("--setopt=proxy=" + *proxy)
+}
+
+// shellQuote quotes a value to be passed as a single argument to a command
+// run by the shell.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
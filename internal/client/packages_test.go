@@ -0,0 +1,36 @@
+package client
+
+import "testing"
+
+func TestShellQuote(t *testing.T) {
+	tests := map[string]string{
+		"@centos-automotive-sig/bluechi-snapshot":    `'@centos-automotive-sig/bluechi-snapshot'`,
+		"https://example.com/key?version=1&format=a": `'https://example.com/key?version=1&format=a'`,
+		"it's":        `'it'\''s'`,
+		"a b; reboot": `'a b; reboot'`,
+	}
+
+	for value, expected := range tests {
+		if quoted := shellQuote(value); quoted != expected {
+			t.Errorf("expected %s to be quoted as %s, got %s", value, expected, quoted)
+		}
+	}
+}
+
+func TestIsCoprRepoListed(t *testing.T) {
+	output := "copr.fedorainfracloud.org/mperina/hirte-snapshot\ncopr.fedorainfracloud.org/group_centos-automotive-sig/bluechi-snapshot\n"
+
+	tests := map[string]bool{
+		"mperina/hirte-snapshot":                  true,
+		"@centos-automotive-sig/bluechi-snapshot": true,
+		"centos-automotive-sig/bluechi-snapshot":  false,
+		"@mperina/hirte-snapshot":                 false,
+		"hirte-snapshot":                          false,
+	}
+
+	for repo, expected := range tests {
+		if listed := isCoprRepoListed(output, repo); listed != expected {
+			t.Errorf("expected %s to be listed: %t, got %t", repo, expected, listed)
+		}
+	}
+}
@@ -1,10 +1,15 @@
 package client
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
@@ -14,6 +19,17 @@ func ignoreHostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey)
 	return nil
 }
 
+func expandHomeDir(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(path, "~/", homeDir+"/", 1), nil
+}
+
 type SSHClient struct {
 	Host                  string
 	User                  string
@@ -45,10 +61,180 @@ func (c *SSHClient) hasRootPrivileges() (bool, error) {
 		return false, fmt.Errorf("failed to determine if root: (%s, %s)", err.Error(), string(output))
 	}
 
-	c.connHasRoot = (string(output) == "root")
+	c.connHasRoot = (strings.TrimSpace(string(output)) == "root")
 	return c.connHasRoot, nil
 }
 
+func (c *SSHClient) sudoPrefix() string {
+	if c.connHasRoot {
+		return ""
+	}
+	return "sudo"
+}
+
+func (c *SSHClient) runCommand(cmd string) ([]byte, error) {
+	session, err := c.newSSHSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	return session.CombinedOutput(cmd)
+}
+
+func (c *SSHClient) writeFile(path string, content string) error {
+	session, err := c.newSSHSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = strings.NewReader(content)
+	output, err := session.CombinedOutput(fmt.Sprintf("%s tee %s > /dev/null", c.sudoPrefix(), shellQuote(path)))
+	if err != nil {
+		return fmt.Errorf("%s", string(output))
+	}
+
+	return nil
+}
+
+// writeFileIfChanged only writes the file if the checksum of the existing
+// file differs from the content and reports whether it has been written.
+func (c *SSHClient) writeFileIfChanged(path string, content string) (bool, error) {
+	existing, err := c.checksum(path)
+	if err == nil {
+		checksum := sha256.Sum256([]byte(content))
+		if existing == hex.EncodeToString(checksum[:]) {
+			return false, nil
+		}
+	}
+
+	return true, c.writeFile(path, content)
+}
+
+// BackupFile copies the file next to itself and reports whether there has
+// been a file to back up.
+func (c *SSHClient) BackupFile(path string) (bool, error) {
+	_, err := c.runCommand(fmt.Sprintf("%s test -f %s", c.sudoPrefix(), path))
+	if err != nil {
+		if _, ok := err.(*ssh.ExitError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+
+	output, err := c.runCommand(fmt.Sprintf("%s cp -p %s %s", c.sudoPrefix(), path, path+backupSuffix))
+	if err != nil {
+		return false, fmt.Errorf("failed to back up '%s': %s", path, string(output))
+	}
+
+	return true, nil
+}
+
+// RestoreFile replaces the file with its backup
+func (c *SSHClient) RestoreFile(path string) error {
+	output, err := c.runCommand(fmt.Sprintf("%s mv -f %s %s", c.sudoPrefix(), path+backupSuffix, path))
+	if err != nil {
+		return fmt.Errorf("failed to restore '%s': %s", path, string(output))
+	}
+
+	return nil
+}
+
+func (c *SSHClient) RemoveBackup(path string) error {
+	output, err := c.runCommand(fmt.Sprintf("%s rm -f %s", c.sudoPrefix(), path+backupSuffix))
+	if err != nil {
+		return fmt.Errorf("failed to remove backup of '%s': %s", path, string(output))
+	}
+
+	return nil
+}
+
+func (c *SSHClient) checksum(path string) (string, error) {
+	output, err := c.runCommand(fmt.Sprintf("%s sha256sum %s", c.sudoPrefix(), shellQuote(path)))
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("failed to compute checksum of '%s'", path)
+	}
+	return fields[0], nil
+}
+
+// PreserveFile keeps a copy of an existing file so it can be restored by
+// RestorePreservedFile and returns its checksum, or an empty string if
+// there is no such file.
+func (c *SSHClient) PreserveFile(path string) (string, error) {
+	checksum, err := c.checksum(path)
+	if err != nil {
+		if _, ok := err.(*ssh.ExitError); ok {
+			return "", nil
+		}
+		return "", err
+	}
+
+	output, err := c.runCommand(fmt.Sprintf("%s cp -p %s %s", c.sudoPrefix(), path, path+preservedSuffix))
+	if err != nil {
+		return "", fmt.Errorf("failed to back up '%s': %s", path, string(output))
+	}
+
+	return checksum, nil
+}
+
+// RestorePreservedFile replaces the file with the copy kept by PreserveFile
+// after verifying that the copy still has the given checksum. A missing copy
+// is fine if the file has already been restored by a previous call.
+func (c *SSHClient) RestorePreservedFile(path string, checksum string) error {
+	preserved := path + preservedSuffix
+	actual, err := c.checksum(preserved)
+	if err != nil {
+		if _, ok := err.(*ssh.ExitError); ok {
+			if restored, err := c.checksum(path); err == nil && restored == checksum {
+				return nil
+			}
+		}
+		return fmt.Errorf("failed to read backup '%s' of the original file: %s", preserved, err.Error())
+	}
+	if actual != checksum {
+		return fmt.Errorf("backup '%s' of the original file has been modified, expected checksum %s but got %s", preserved, checksum, actual)
+	}
+
+	output, err := c.runCommand(fmt.Sprintf("%s mv -f %s %s", c.sudoPrefix(), preserved, path))
+	if err != nil {
+		return fmt.Errorf("failed to restore '%s': %s", path, string(output))
+	}
+
+	return nil
+}
+
+func (c *SSHClient) uploadFile(localPath string, remotePath string) error {
+	localPath, err := expandHomeDir(localPath)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	session, err := c.newSSHSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	session.Stdin = file
+	output, err := session.CombinedOutput(fmt.Sprintf("cat > %s", shellQuote(remotePath)))
+	if err != nil {
+		return fmt.Errorf("failed to upload '%s': %s", localPath, string(output))
+	}
+
+	return nil
+}
+
 func (c *SSHClient) isServiceInstalled(service string) (bool, error) {
 	session, err := c.newSSHSession()
 	if err != nil {
@@ -67,37 +253,95 @@ func (c *SSHClient) isServiceInstalled(service string) (bool, error) {
 	return strings.Contains(string(output), service), nil
 }
 
-func (c *SSHClient) determineOS() (string, error) {
-	session, err := c.newSSHSession()
+func (c *SSHClient) determineOS() (OSInfo, error) {
+	osInfo := OSInfo{}
+
+	output, err := c.runCommand("cat /etc/os-release")
 	if err != nil {
-		return "", err
+		return osInfo, fmt.Errorf("failed to determine os: %s", string(output))
 	}
-	defer session.Close()
 
-	output, err := session.Output("cat /etc/os-release | grep -w ID=")
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found {
+			continue
+		}
+		value = strings.Trim(value, "\"'")
+		switch key {
+		case "ID":
+			osInfo.ID = value
+		case "VERSION_ID":
+			osInfo.VersionID = value
+		}
+	}
+
+	// rpm-ostree and bootc based systems are marked by this file
+	_, err = c.runCommand("test -e /run/ostree-booted")
+	if err == nil {
+		osInfo.ImageMode = true
+	} else if _, ok := err.(*ssh.ExitError); !ok {
+		return osInfo, fmt.Errorf("failed to determine if os is image based: %s", err.Error())
+	}
+
+	return osInfo, nil
+}
+
+func (c *SSHClient) bootID() (string, error) {
+	output, err := c.runCommand("cat /proc/sys/kernel/random/boot_id")
 	if err != nil {
-		return "", fmt.Errorf("failed to determine os: %s", string(output))
+		return "", fmt.Errorf("failed to read boot id: %s", string(output))
 	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (c *SSHClient) rebootAndWait(timeout time.Duration) error {
+	bootID, err := c.bootID()
+	if err != nil {
+		return err
+	}
+
+	// the connection is terminated by the reboot, so the result is ignored
+	_, _ = c.runCommand(fmt.Sprintf("%s systemctl reboot", c.sudoPrefix()))
+	_ = c.Disconnect()
+	c.conn = nil
+
+	deadline := time.Now().Add(timeout)
+	for {
+		time.Sleep(rebootPollInterval)
+
+		// while the machine is down connecting may block until the TCP
+		// timeout of the kernel, so it is bound by the remaining time
+		err = c.connect(max(time.Until(deadline), rebootPollInterval))
+		if err == nil {
+			newBootID, err := c.bootID()
+			if err == nil && newBootID != bootID {
+				return nil
+			}
+			_ = c.Disconnect()
+			c.conn = nil
+		}
 
-	os := strings.ReplaceAll(string(output), "ID=", "")
-	os = strings.ReplaceAll(os, "\"", "")
-	return strings.TrimSpace(os), nil
+		if time.Now().After(deadline) {
+			return fmt.Errorf("machine did not come back within %s after reboot", timeout)
+		}
+	}
 }
 
 func (c *SSHClient) Connect() error {
+	return c.connect(0)
+}
+
+// connect establishes the connection, a timeout of 0 waits as long as the
+// kernel tries to connect.
+func (c *SSHClient) connect(timeout time.Duration) error {
 	var err error
 	var authMethods []ssh.AuthMethod
 	var hostkeyCallback ssh.HostKeyCallback
 
 	if c.PKPath != "" {
-		pkPath := c.PKPath
-		// resolve home directory
-		if strings.HasPrefix(pkPath, "~/") {
-			homeDir, err := os.UserHomeDir()
-			if err != nil {
-				return err
-			}
-			pkPath = strings.Replace(pkPath, "~/", homeDir+"/", 1)
+		pkPath, err := expandHomeDir(c.PKPath)
+		if err != nil {
+			return err
 		}
 		pKey, err := os.ReadFile(pkPath)
 		if err != nil {
@@ -134,6 +378,7 @@ func (c *SSHClient) Connect() error {
 		User:            c.User,
 		HostKeyCallback: hostkeyCallback,
 		Auth:            authMethods,
+		Timeout:         timeout,
 	}
 
 	c.conn, err = ssh.Dial("tcp", c.Host, conf)
@@ -143,6 +388,8 @@ func (c *SSHClient) Connect() error {
 
 	_, err = c.hasRootPrivileges()
 	if err != nil {
+		_ = c.conn.Close()
+		c.conn = nil
 		return err
 	}
 
@@ -163,213 +410,712 @@ func (c *SSHClient) Disconnect() error {
 	return nil
 }
 
-func (c *SSHClient) InstallBlueChi(installCtrl bool, installAgent bool) error {
+func (c *SSHClient) isPackageInstalled(os string, pkg string) (bool, error) {
+	cmd := fmt.Sprintf("rpm -q %s", pkg)
+	if isAPTBased(os) {
+		cmd = fmt.Sprintf("dpkg -s %s", pkg)
+	}
+
+	output, err := c.runCommand(cmd)
+	if err != nil {
+		if _, ok := err.(*ssh.ExitError); ok {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check if package '%s' is installed: %s", pkg, string(output))
+	}
+
+	return true, nil
+}
+
+func (c *SSHClient) InstallBlueChi(cfg InstallConfig) ([]string, error) {
 	needsInstallCtrl := false
 	needsInstallAgent := false
 
-	if installCtrl {
-		isInstalled, err := c.isServiceInstalled("bluechi-controller.service")
+	if cfg.Controller {
+		isInstalled, err := c.isServiceInstalled(BlueChiControllerService)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		needsInstallCtrl = !isInstalled
 	}
-	if installAgent {
-		isInstalled, err := c.isServiceInstalled("bluechi-agent.service")
+	if cfg.Agent {
+		isInstalled, err := c.isServiceInstalled(BlueChiAgentService)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		needsInstallAgent = !isInstalled
 	}
 
-	if !needsInstallCtrl && !needsInstallAgent {
-		return nil
+	if !needsInstallCtrl && !needsInstallAgent && len(cfg.Components) == 0 {
+		return []string{}, nil
 	}
 
-	os, err := c.determineOS()
+	osInfo, err := c.determineOS()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if os == "autosd" || os == "centos" {
-		packagesToInstall := ""
+	installLocal := len(cfg.LocalPackages) > 0 && (needsInstallCtrl || needsInstallAgent)
+	packagesToInstall := []string{}
+	if len(cfg.LocalPackages) == 0 {
 		if needsInstallCtrl {
-			packagesToInstall += " bluechi-controller bluechi-ctl "
+			packagesToInstall = append(packagesToInstall, ControllerPackages...)
 		}
 		if needsInstallAgent {
-			packagesToInstall += " bluechi-agent"
+			packagesToInstall = append(packagesToInstall, AgentPackages...)
 		}
+	}
 
+	for _, component := range cfg.Components {
+		isInstalled, err := c.isPackageInstalled(osInfo.ID, component)
+		if err != nil {
+			return nil, err
+		}
+		if !isInstalled {
+			packagesToInstall = append(packagesToInstall, component)
+		}
+	}
+
+	if !installLocal && len(packagesToInstall) == 0 {
+		return []string{}, nil
+	}
+
+	if osInfo.ImageMode && cfg.ImageMode != ImageModeLayer {
+		missing := append([]string{}, packagesToInstall...)
+		if installLocal {
+			missing = append(missing, cfg.LocalPackages...)
+		}
+		return nil, fmt.Errorf(
+			"'%s' is an image based system and BlueChi packages are missing in the image: %s",
+			osInfo.ID, strings.Join(missing, ", "),
+		)
+	}
+
+	installedPackages := []string{}
+	if installLocal {
+		installedPackages, err = c.installLocalPackages(osInfo, cfg.LocalPackages)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(packagesToInstall) > 0 && osInfo.ImageMode {
+		cmd := fmt.Sprintf("%s rpm-ostree install --idempotent -y %s", c.sudoPrefix(), strings.Join(packagesToInstall, " "))
+		output, err := c.runCommand(cmd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to layer packages '%s': %s", strings.Join(packagesToInstall, ", "), string(output))
+		}
+		installedPackages = append(installedPackages, packagesToInstall...)
+	} else if len(packagesToInstall) > 0 && isDNFBased(osInfo.ID) {
 		session, err := c.newSSHSession()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		defer session.Close()
 
-		sudoPrefix := ""
-		if c.connHasRoot {
-			sudoPrefix = "sudo"
+		sudoPrefix := c.sudoPrefix()
+		output, err := session.Output(fmt.Sprintf("%s dnf install -y %s %s", sudoPrefix, dnfProxyOption(cfg.Proxy), strings.Join(packagesToInstall, " ")))
+		if err != nil {
+			return nil, fmt.Errorf("failed to install packages '%s': %s", strings.Join(packagesToInstall, ", "), output)
 		}
-		output, err := session.Output(fmt.Sprintf("%s dnf install -y %s", sudoPrefix, packagesToInstall))
+		installedPackages = append(installedPackages, packagesToInstall...)
+	}
+
+	// layered packages are only available after booting into the new deployment
+	if osInfo.ImageMode {
+		if err := c.rebootAndWait(cfg.RebootTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	return installedPackages, nil
+}
+
+func (c *SSHClient) GetPackageVersions(packages []string) (map[string]string, error) {
+	versions := map[string]string{}
+	if len(packages) == 0 {
+		return versions, nil
+	}
+
+	osInfo, err := c.determineOS()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pkg := range packages {
+		cmd := fmt.Sprintf("rpm -q --qf '%%{VERSION}-%%{RELEASE}' %s", pkg)
+		if isAPTBased(osInfo.ID) {
+			cmd = fmt.Sprintf("dpkg-query -W -f='${Version}' %s", pkg)
+		}
+
+		output, err := c.runCommand(cmd)
 		if err != nil {
-			return fmt.Errorf("failed to install packages '%s': %s", packagesToInstall, output)
+			if _, ok := err.(*ssh.ExitError); ok {
+				// package is not installed
+				continue
+			}
+			return nil, fmt.Errorf("failed to determine version of package '%s': %s", pkg, string(output))
 		}
+		versions[pkg] = strings.TrimSpace(string(output))
 	}
 
-	return nil
+	return versions, nil
 }
 
-func (c *SSHClient) CreateControllerConfig(file string, cfg BlueChiControllerConfig) error {
-	session, err := c.newSSHSession()
+func (c *SSHClient) installLocalPackages(osInfo OSInfo, packages []string) ([]string, error) {
+	var installCmd, nameCmd string
+	if osInfo.ImageMode {
+		installCmd = "rpm-ostree install --idempotent -y"
+		nameCmd = "rpm -qp --qf '%{NAME}\\n'"
+	} else if isDNFBased(osInfo.ID) {
+		installCmd = "dnf install -y"
+		nameCmd = "rpm -qp --qf '%{NAME}\\n'"
+	} else if isAPTBased(osInfo.ID) {
+		installCmd = "apt install -y"
+		nameCmd = "dpkg-deb --showformat='${Package}\\n' --show"
+	} else {
+		return nil, fmt.Errorf("installing local packages is not supported on '%s'", osInfo.ID)
+	}
+
+	output, err := c.runCommand("mktemp -d")
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to create temporary directory: %s", string(output))
+	}
+	tmpDir := strings.TrimSpace(string(output))
+	defer c.runCommand(fmt.Sprintf("rm -rf %s", shellQuote(tmpDir)))
+
+	remotePackages := []string{}
+	for _, pkg := range packages {
+		remotePkg := tmpDir + "/" + filepath.Base(pkg)
+		if err := c.uploadFile(pkg, remotePkg); err != nil {
+			return nil, err
+		}
+		remotePackages = append(remotePackages, remotePkg)
 	}
-	defer session.Close()
 
-	sudoPrefix := ""
-	if c.connHasRoot {
-		sudoPrefix = "sudo"
+	installedPackages := []string{}
+	for _, remotePkg := range remotePackages {
+		output, err = c.runCommand(fmt.Sprintf("%s %s", nameCmd, shellQuote(remotePkg)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine package name of '%s': %s", remotePkg, string(output))
+		}
+		installedPackages = append(installedPackages, strings.TrimSpace(string(output)))
 	}
-	cmd := fmt.Sprintf("%s bash -c 'echo \"%s\" > %s'", sudoPrefix, cfg.Serialize(), BlueChiControllerConfdDirectory+file)
-	output, err := session.Output(cmd)
+
+	quotedPackages := []string{}
+	for _, remotePkg := range remotePackages {
+		quotedPackages = append(quotedPackages, shellQuote(remotePkg))
+	}
+	cmd := fmt.Sprintf("%s %s %s", c.sudoPrefix(), installCmd, strings.Join(quotedPackages, " "))
+	output, err = c.runCommand(cmd)
 	if err != nil {
-		return fmt.Errorf("failed to create controller config file: %s", string(output))
+		return nil, fmt.Errorf("failed to install local packages '%s': %s", strings.Join(packages, ", "), string(output))
 	}
 
-	return nil
+	return installedPackages, nil
 }
 
-func (c *SSHClient) RemoveControllerConfig(file string) error {
-	session, err := c.newSSHSession()
+func (c *SSHClient) GetBlueChiVersion() (*BlueChiVersion, error) {
+	// older BlueChi releases shipped the controller in the bluechi package
+	versions, err := c.GetPackageVersions([]string{"bluechi-controller", "bluechi-agent", "bluechi"})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pkg := range []string{"bluechi-controller", "bluechi-agent", "bluechi"} {
+		if pkgVersion, ok := versions[pkg]; ok {
+			version, err := ParseBlueChiVersion(pkgVersion)
+			if err != nil {
+				return nil, err
+			}
+			return &version, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (c *SSHClient) UninstallPackages(packages []string) error {
+	if len(packages) == 0 {
+		return nil
+	}
+
+	osInfo, err := c.determineOS()
 	if err != nil {
 		return err
 	}
-	defer session.Close()
 
-	sudoPrefix := ""
-	if c.connHasRoot {
-		sudoPrefix = "sudo"
+	var uninstallCmd string
+	if osInfo.ImageMode {
+		uninstallCmd = "rpm-ostree uninstall -y"
+	} else if isDNFBased(osInfo.ID) {
+		uninstallCmd = "dnf remove -y"
+	} else if isAPTBased(osInfo.ID) {
+		uninstallCmd = "apt remove -y"
+	} else {
+		return fmt.Errorf("uninstalling packages is not supported on '%s'", osInfo.ID)
 	}
-	cmd := fmt.Sprintf("%s rm %s", sudoPrefix, BlueChiControllerConfdDirectory+file)
-	output, err := session.Output(cmd)
+
+	// packages which are not installed anymore are skipped
+	installed := []string{}
+	for _, pkg := range packages {
+		isInstalled, err := c.isPackageInstalled(osInfo.ID, pkg)
+		if err != nil {
+			return err
+		}
+		if isInstalled {
+			installed = append(installed, pkg)
+		}
+	}
+	if len(installed) == 0 {
+		return nil
+	}
+
+	output, err := c.runCommand(fmt.Sprintf("%s %s %s", c.sudoPrefix(), uninstallCmd, strings.Join(installed, " ")))
 	if err != nil {
-		return fmt.Errorf("failed to remove controller config file: %s", string(output))
+		return fmt.Errorf("failed to uninstall packages '%s': %s", strings.Join(installed, ", "), string(output))
 	}
 
 	return nil
 }
 
-func (c *SSHClient) RestartBlueChiController() error {
-	session, err := c.newSSHSession()
+func (c *SSHClient) listGPGKeys() ([]string, error) {
+	output, err := c.runCommand("rpm -q gpg-pubkey --qf '%{NAME}-%{VERSION}-%{RELEASE}\\n'")
 	if err != nil {
-		return err
+		// rpm exits with 1 if no gpg key has been imported yet
+		if serr, ok := err.(*ssh.ExitError); ok && serr.ExitStatus() == 1 {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("failed to list gpg keys: %s", string(output))
 	}
-	defer session.Close()
 
-	sudoPrefix := ""
-	if c.connHasRoot {
-		sudoPrefix = "sudo"
+	return strings.Fields(string(output)), nil
+}
+
+func (c *SSHClient) isCoprRepoEnabled(repo string) (bool, error) {
+	output, err := c.runCommand("dnf copr list --enabled")
+	if err != nil {
+		return false, fmt.Errorf("failed to list copr repositories: %s", string(output))
+	}
+
+	return isCoprRepoListed(string(output), repo), nil
+}
+
+func (c *SSHClient) ConfigurePackageSource(cfg PackageSourceConfig) (ManagedPackageSource, error) {
+	managed := ManagedPackageSource{
+		RepoFiles: []string{},
+		CoprRepos: []string{},
+		GPGKeys:   []string{},
+	}
+
+	osInfo, err := c.determineOS()
+	if err != nil {
+		return managed, err
+	}
+	if !isDNFBased(osInfo.ID) {
+		return managed, fmt.Errorf("package sources are not supported on '%s'", osInfo.ID)
+	}
+
+	sudoPrefix := c.sudoPrefix()
+
+	for name, content := range cfg.RepoFiles {
+		repoFile := YumReposDirectory + name + ".repo"
+		output, err := c.runCommand(fmt.Sprintf("test -e %s", shellQuote(repoFile)))
+		if err == nil {
+			// repository definition exists already and is not managed by us,
+			// it's only used if it matches the configured one
+			existing, err := c.checksum(repoFile)
+			if err != nil {
+				return managed, fmt.Errorf("failed to check repository file '%s': %s", repoFile, err.Error())
+			}
+			checksum := sha256.Sum256([]byte(content))
+			if existing != hex.EncodeToString(checksum[:]) {
+				return managed, fmt.Errorf("repository file '%s' exists already with a different definition, remove it or use another name", repoFile)
+			}
+			continue
+		}
+		if _, ok := err.(*ssh.ExitError); !ok {
+			return managed, fmt.Errorf("failed to check repository file '%s': %s", repoFile, string(output))
+		}
+
+		err = c.writeFile(repoFile, content)
+		if err != nil {
+			return managed, fmt.Errorf("failed to create repository file '%s': %s", repoFile, err.Error())
+		}
+		managed.RepoFiles = append(managed.RepoFiles, name)
+	}
+
+	for _, repo := range cfg.CoprRepos {
+		isEnabled, err := c.isCoprRepoEnabled(repo)
+		if err != nil {
+			return managed, err
+		}
+		if isEnabled {
+			continue
+		}
+
+		cmd := fmt.Sprintf("%s dnf copr enable -y %s %s", sudoPrefix, dnfProxyOption(cfg.Proxy), shellQuote(repo))
+		output, err := c.runCommand(cmd)
+		if err != nil {
+			return managed, fmt.Errorf("failed to enable copr repository '%s': %s", repo, string(output))
+		}
+		managed.CoprRepos = append(managed.CoprRepos, repo)
+	}
+
+	if len(cfg.GPGKeys) > 0 {
+		keysBefore, err := c.listGPGKeys()
+		if err != nil {
+			return managed, err
+		}
+
+		for _, key := range cfg.GPGKeys {
+			output, err := c.runCommand(fmt.Sprintf("%s rpm --import %s", sudoPrefix, shellQuote(key)))
+			if err != nil {
+				return managed, fmt.Errorf("failed to import gpg key '%s': %s", key, string(output))
+			}
+		}
+
+		keysAfter, err := c.listGPGKeys()
+		if err != nil {
+			return managed, err
+		}
+		for _, key := range keysAfter {
+			if !slices.Contains(keysBefore, key) {
+				managed.GPGKeys = append(managed.GPGKeys, key)
+			}
+		}
+	}
+
+	return managed, nil
+}
+
+func (c *SSHClient) RemovePackageSource(managed ManagedPackageSource) error {
+	sudoPrefix := c.sudoPrefix()
+
+	// sources which have been removed already are skipped
+	importedKeys := []string{}
+	if len(managed.GPGKeys) > 0 {
+		keys, err := c.listGPGKeys()
+		if err != nil {
+			return err
+		}
+		importedKeys = keys
+	}
+	for _, key := range managed.GPGKeys {
+		if !slices.Contains(importedKeys, key) {
+			continue
+		}
+		output, err := c.runCommand(fmt.Sprintf("%s rpm -e %s", sudoPrefix, shellQuote(key)))
+		if err != nil {
+			return fmt.Errorf("failed to remove gpg key '%s': %s", key, string(output))
+		}
+	}
+
+	for _, repo := range managed.CoprRepos {
+		enabled, err := c.isCoprRepoEnabled(repo)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			continue
+		}
+		output, err := c.runCommand(fmt.Sprintf("%s dnf copr remove -y %s", sudoPrefix, shellQuote(repo)))
+		if err != nil {
+			return fmt.Errorf("failed to remove copr repository '%s': %s", repo, string(output))
+		}
+	}
+
+	for _, name := range managed.RepoFiles {
+		repoFile := YumReposDirectory + name + ".repo"
+		output, err := c.runCommand(fmt.Sprintf("%s rm -f %s", sudoPrefix, shellQuote(repoFile)))
+		if err != nil {
+			return fmt.Errorf("failed to remove repository file '%s': %s", repoFile, string(output))
+		}
+	}
+
+	return nil
+}
+
+func (c *SSHClient) SetServiceEnabled(service string, enabled bool) error {
+	action := "enable"
+	if !enabled {
+		action = "disable"
 	}
-	output, err := session.Output(fmt.Sprintf("%ssystemctl start bluechi-controller", sudoPrefix))
+
+	output, err := c.runCommand(fmt.Sprintf("%s systemctl %s %s", c.sudoPrefix(), action, service))
 	if err != nil {
-		return fmt.Errorf("failed to restart controller service: %s", string(output))
+		return c.withServiceDiagnostics(service, fmt.Errorf("failed to %s service '%s': %s", action, service, string(output)))
 	}
 
 	return nil
 }
 
-func (c *SSHClient) StopBlueChiController() error {
-	session, err := c.newSSHSession()
+func (c *SSHClient) daemonReload() error {
+	output, err := c.runCommand(fmt.Sprintf("%s systemctl daemon-reload", c.sudoPrefix()))
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to reload systemd: %s", string(output))
 	}
-	defer session.Close()
 
-	sudoPrefix := ""
-	if c.connHasRoot {
-		sudoPrefix = "sudo"
+	return nil
+}
+
+func (c *SSHClient) CreateServiceOverrides(service string, overrides ServiceOverrides) (bool, error) {
+	dir := ServiceOverridesDirectory(service)
+	output, err := c.runCommand(fmt.Sprintf("%s mkdir -p %s", c.sudoPrefix(), dir))
+	if err != nil {
+		return false, fmt.Errorf("failed to create directory '%s': %s", dir, string(output))
 	}
-	output, err := session.Output(fmt.Sprintf("%s systemctl stop bluechi-controller", sudoPrefix))
+
+	changed, err := c.writeFileIfChanged(dir+ServiceOverridesFile, overrides.Serialize())
 	if err != nil {
-		return fmt.Errorf("failed to stop controller service: %s", string(output))
+		return false, fmt.Errorf("failed to create overrides for service '%s': %s", service, err.Error())
+	}
+	if !changed {
+		return false, nil
+	}
+
+	return true, c.daemonReload()
+}
+
+func (c *SSHClient) RemoveServiceOverrides(service string) error {
+	file := ServiceOverridesDirectory(service) + ServiceOverridesFile
+	output, err := c.runCommand(fmt.Sprintf("%s rm -f %s", c.sudoPrefix(), file))
+	if err != nil {
+		return fmt.Errorf("failed to remove overrides for service '%s': %s", service, string(output))
+	}
+
+	return c.daemonReload()
+}
+
+// waitFor runs the check until it succeeds or the timeout is exceeded
+func (c *SSHClient) waitFor(check string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		output, err := c.runCommand(check)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*ssh.ExitError); !ok {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s: %s", timeout, strings.TrimSpace(string(output)))
+		}
+		time.Sleep(onlinePollInterval)
+	}
+}
+
+func (c *SSHClient) WaitForControllerOnline(port int64, timeout time.Duration) error {
+	// without TCP there is no port to check, only the service state
+	check := fmt.Sprintf("systemctl is-active %s", BlueChiControllerService)
+	failure := "controller is not active"
+	if port > 0 {
+		check += fmt.Sprintf(" && ss -Hltn 'sport = :%d' | grep -q .", port)
+		failure = fmt.Sprintf("controller is not listening on port %d", port)
+	}
+
+	err := c.waitFor(check, timeout)
+	if err != nil {
+		return c.withServiceDiagnostics(BlueChiControllerService, fmt.Errorf("%s: %s", failure, err.Error()))
 	}
 
 	return nil
 }
 
-func (c *SSHClient) CreateAgentConfig(file string, cfg BlueChiAgentConfig) error {
-	session, err := c.newSSHSession()
+func (c *SSHClient) WaitForAgentOnline(timeout time.Duration) error {
+	// bluechi-is-online is an optional component, fall back to the service state
+	script := fmt.Sprintf(
+		"if command -v bluechi-is-online > /dev/null; then bluechi-is-online agent; else systemctl is-active %s; fi",
+		BlueChiAgentService,
+	)
+
+	err := c.waitFor(fmt.Sprintf("%s sh -c '%s'", c.sudoPrefix(), script), timeout)
 	if err != nil {
-		return err
+		return c.withServiceDiagnostics(BlueChiAgentService, fmt.Errorf("agent is not online: %s", err.Error()))
 	}
-	defer session.Close()
 
-	sudoPrefix := ""
-	if c.connHasRoot {
-		sudoPrefix = "sudo"
+	return nil
+}
+
+// isUnitNotLoaded checks if systemctl failed because the unit doesn't exist,
+// e.g. since the package has been uninstalled already.
+func isUnitNotLoaded(err error) bool {
+	serr, ok := err.(*ssh.ExitError)
+	return ok && serr.ExitStatus() == systemctlUnitNotLoaded
+}
+
+// withServiceDiagnostics appends the status and the last journal entries of
+// the service to the error, so failures can be debugged without logging in.
+func (c *SSHClient) withServiceDiagnostics(service string, err error) error {
+	details := ""
+
+	// systemctl status exits with a non-zero status for failed services
+	status, _ := c.runCommand(fmt.Sprintf("%s systemctl status %s --no-pager --full --lines=0", c.sudoPrefix(), service))
+	if trimmed := strings.TrimSpace(string(status)); trimmed != "" {
+		details += fmt.Sprintf("\n\nsystemctl status %s:\n%s", service, trimmed)
+	}
+
+	logs, logErr := c.runCommand(fmt.Sprintf("%s journalctl -u %s -n %d --no-pager", c.sudoPrefix(), service, serviceLogLines))
+	if trimmed := strings.TrimSpace(string(logs)); logErr == nil && trimmed != "" {
+		details += fmt.Sprintf("\n\nLast journal entries of %s:\n%s", service, trimmed)
+	}
+
+	return fmt.Errorf("%s%s", err.Error(), details)
+}
+
+func (c *SSHClient) GetServiceStatus(service string) (ServiceStatus, error) {
+	status := ServiceStatus{}
+
+	// both commands exit with a non-zero status if the service is
+	// disabled or inactive, so only the output is evaluated
+	output, err := c.runCommand(fmt.Sprintf("systemctl is-enabled %s", service))
+	if _, ok := err.(*ssh.ExitError); err != nil && !ok {
+		return status, fmt.Errorf("failed to check if service '%s' is enabled: %s", service, string(output))
 	}
-	cmd := fmt.Sprintf("%s bash -c 'echo \"%s\" > %s'", sudoPrefix, cfg.Serialize(), BlueChiAgentConfdDirectory+file)
-	output, err := session.Output(cmd)
+	status.Enabled = strings.TrimSpace(string(output)) == "enabled"
+
+	output, err = c.runCommand(fmt.Sprintf("systemctl is-active %s", service))
+	if _, ok := err.(*ssh.ExitError); err != nil && !ok {
+		return status, fmt.Errorf("failed to check if service '%s' is active: %s", service, string(output))
+	}
+	status.Active = strings.TrimSpace(string(output)) == "active"
+
+	return status, nil
+}
+
+func (c *SSHClient) CreateControllerConfig(file string, cfg BlueChiControllerConfig) (bool, error) {
+	// the content is passed via stdin to avoid any shell quoting of values
+	changed, err := c.writeFileIfChanged(BlueChiControllerConfdDirectory+file, cfg.Serialize())
+	if err != nil {
+		return false, fmt.Errorf("failed to create controller config file: %s", err.Error())
+	}
+
+	return changed, nil
+}
+
+func (c *SSHClient) ListManagedConfigs(dir string) (map[string]string, error) {
+	managed := map[string]string{}
+
+	cmd := fmt.Sprintf("%s grep -H -m1 '^%s' %s*.conf", c.sudoPrefix(), ManagedConfigMarker, dir)
+	output, err := c.runCommand(cmd)
+	if err != nil {
+		// grep exits with 1 if nothing matched and with 2 if there are no files
+		if serr, ok := err.(*ssh.ExitError); ok && (serr.ExitStatus() == 1 || serr.ExitStatus() == 2) {
+			return managed, nil
+		}
+		return nil, fmt.Errorf("failed to list managed config files in '%s': %s", dir, string(output))
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		file, marker, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		managed[filepath.Base(file)] = strings.TrimSpace(strings.TrimPrefix(marker, ManagedConfigMarker))
+	}
+
+	return managed, nil
+}
+
+func (c *SSHClient) GetEffectiveConfig(mainFile string, dir string) (EffectiveConfig, error) {
+	script := fmt.Sprintf(
+		`export LC_ALL=C; for f in %s %s*.conf; do if [ -f "$f" ]; then echo "%s$f"; cat "$f"; echo; fi; done`,
+		mainFile, dir, configFileSeparator,
+	)
+	output, err := c.runCommand(fmt.Sprintf("%s sh -c '%s'", c.sudoPrefix(), script))
 	if err != nil {
-		return fmt.Errorf("failed to create agent config file: %s", string(output))
+		return EffectiveConfig{}, fmt.Errorf("failed to read config files in '%s': %s", dir, string(output))
+	}
+
+	files, contents := splitConfigFiles(string(output))
+	return mergeConfigFiles(files, contents), nil
+}
+
+func (c *SSHClient) RemoveControllerConfig(file string) error {
+	// an already removed file is not an error
+	output, err := c.runCommand(fmt.Sprintf("%s rm -f %s", c.sudoPrefix(), BlueChiControllerConfdDirectory+file))
+	if err != nil {
+		return fmt.Errorf("failed to remove controller config file: %s", string(output))
 	}
 
 	return nil
 }
 
-func (c *SSHClient) RemoveAgentConfig(file string) error {
-	session, err := c.newSSHSession()
+func (c *SSHClient) RestartBlueChiController() error {
+	output, err := c.runCommand(fmt.Sprintf("%s systemctl restart %s", c.sudoPrefix(), BlueChiControllerService))
 	if err != nil {
-		return err
+		return c.withServiceDiagnostics(BlueChiControllerService, fmt.Errorf("failed to restart controller service: %s", string(output)))
 	}
-	defer session.Close()
 
-	sudoPrefix := ""
-	if c.connHasRoot {
-		sudoPrefix = "sudo"
+	return nil
+}
+
+func (c *SSHClient) StartBlueChiController() error {
+	output, err := c.runCommand(fmt.Sprintf("%s systemctl start %s", c.sudoPrefix(), BlueChiControllerService))
+	if err != nil {
+		return c.withServiceDiagnostics(BlueChiControllerService, fmt.Errorf("failed to start controller service: %s", string(output)))
+	}
+
+	return nil
+}
+
+func (c *SSHClient) StopBlueChiController() error {
+	output, err := c.runCommand(fmt.Sprintf("%s systemctl stop %s", c.sudoPrefix(), BlueChiControllerService))
+	if isUnitNotLoaded(err) {
+		return nil
 	}
-	cmd := fmt.Sprintf("%s rm %s", sudoPrefix, BlueChiAgentConfdDirectory+file)
-	output, err := session.Output(cmd)
 	if err != nil {
-		return fmt.Errorf("failed to remove agent config file: %s", string(output))
+		return c.withServiceDiagnostics(BlueChiControllerService, fmt.Errorf("failed to stop controller service: %s", string(output)))
 	}
 
 	return nil
 }
 
-func (c *SSHClient) RestartBlueChiAgent() error {
-	session, err := c.newSSHSession()
+func (c *SSHClient) CreateAgentConfig(file string, cfg BlueChiAgentConfig) (bool, error) {
+	// the content is passed via stdin to avoid any shell quoting of values
+	changed, err := c.writeFileIfChanged(BlueChiAgentConfdDirectory+file, cfg.Serialize())
 	if err != nil {
-		return err
+		return false, fmt.Errorf("failed to create agent config file: %s", err.Error())
 	}
-	defer session.Close()
 
-	sudoPrefix := ""
-	if c.connHasRoot {
-		sudoPrefix = "sudo"
+	return changed, nil
+}
+
+func (c *SSHClient) RemoveAgentConfig(file string) error {
+	// an already removed file is not an error
+	output, err := c.runCommand(fmt.Sprintf("%s rm -f %s", c.sudoPrefix(), BlueChiAgentConfdDirectory+file))
+	if err != nil {
+		return fmt.Errorf("failed to remove agent config file: %s", string(output))
 	}
-	output, err := session.Output(fmt.Sprintf("%s systemctl start bluechi-agent", sudoPrefix))
+
+	return nil
+}
+
+func (c *SSHClient) RestartBlueChiAgent() error {
+	output, err := c.runCommand(fmt.Sprintf("%s systemctl restart %s", c.sudoPrefix(), BlueChiAgentService))
 	if err != nil {
-		return fmt.Errorf("failed to restart agent service: %s", string(output))
+		return c.withServiceDiagnostics(BlueChiAgentService, fmt.Errorf("failed to restart agent service: %s", string(output)))
 	}
 
 	return nil
 }
 
-func (c *SSHClient) StopBlueChiAgent() error {
-	session, err := c.newSSHSession()
+func (c *SSHClient) StartBlueChiAgent() error {
+	output, err := c.runCommand(fmt.Sprintf("%s systemctl start %s", c.sudoPrefix(), BlueChiAgentService))
 	if err != nil {
-		return err
+		return c.withServiceDiagnostics(BlueChiAgentService, fmt.Errorf("failed to start agent service: %s", string(output)))
 	}
-	defer session.Close()
 
-	sudoPrefix := ""
-	if c.connHasRoot {
-		sudoPrefix = "sudo"
+	return nil
+}
+
+func (c *SSHClient) StopBlueChiAgent() error {
+	output, err := c.runCommand(fmt.Sprintf("%s systemctl stop %s", c.sudoPrefix(), BlueChiAgentService))
+	if isUnitNotLoaded(err) {
+		return nil
 	}
-	output, err := session.Output(fmt.Sprintf("%s systemctl stop bluechi-agent", sudoPrefix))
 	if err != nil {
-		return fmt.Errorf("failed to stop agent service: %s", string(output))
+		return c.withServiceDiagnostics(BlueChiAgentService, fmt.Errorf("failed to stop agent service: %s", string(output)))
 	}
 
 	return nil
@@ -399,14 +1145,70 @@ func (c *SSHClientMock) Disconnect() error {
 	return nil
 }
 
-func (c *SSHClientMock) InstallBlueChi(installCtrl bool, installAgent bool) error {
+func (c *SSHClientMock) InstallBlueChi(cfg InstallConfig) ([]string, error) {
+	return []string{}, nil
+}
+
+func (c *SSHClientMock) UninstallPackages(packages []string) error {
+	return nil
+}
+
+func (c *SSHClientMock) GetBlueChiVersion() (*BlueChiVersion, error) {
+	return nil, nil
+}
+
+func (c *SSHClientMock) GetPackageVersions(packages []string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (c *SSHClientMock) ConfigurePackageSource(cfg PackageSourceConfig) (ManagedPackageSource, error) {
+	return ManagedPackageSource{
+		RepoFiles: []string{},
+		CoprRepos: []string{},
+		GPGKeys:   []string{},
+	}, nil
+}
+
+func (c *SSHClientMock) RemovePackageSource(managed ManagedPackageSource) error {
+	return nil
+}
+
+func (c *SSHClientMock) SetServiceEnabled(service string, enabled bool) error {
+	return nil
+}
+
+func (c *SSHClientMock) CreateServiceOverrides(service string, overrides ServiceOverrides) (bool, error) {
+	return true, nil
+}
+
+func (c *SSHClientMock) RemoveServiceOverrides(service string) error {
+	return nil
+}
+
+func (c *SSHClientMock) WaitForControllerOnline(port int64, timeout time.Duration) error {
 	return nil
 }
 
-func (c *SSHClientMock) CreateControllerConfig(file string, cfg BlueChiControllerConfig) error {
+func (c *SSHClientMock) WaitForAgentOnline(timeout time.Duration) error {
 	return nil
 }
 
+func (c *SSHClientMock) GetServiceStatus(service string) (ServiceStatus, error) {
+	return ServiceStatus{Enabled: true, Active: true}, nil
+}
+
+func (c *SSHClientMock) CreateControllerConfig(file string, cfg BlueChiControllerConfig) (bool, error) {
+	return true, nil
+}
+
+func (c *SSHClientMock) ListManagedConfigs(dir string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (c *SSHClientMock) GetEffectiveConfig(mainFile string, dir string) (EffectiveConfig, error) {
+	return EffectiveConfig{Values: map[string]string{}, Sources: map[string]string{}}, nil
+}
+
 func (c *SSHClientMock) RemoveControllerConfig(string) error {
 	return nil
 }
@@ -415,14 +1217,18 @@ func (c *SSHClientMock) RestartBlueChiController() error {
 	return nil
 }
 
-func (c *SSHClientMock) StopBlueChiController() error {
+func (c *SSHClientMock) StartBlueChiController() error {
 	return nil
 }
 
-func (c *SSHClientMock) CreateAgentConfig(file string, cfg BlueChiAgentConfig) error {
+func (c *SSHClientMock) StopBlueChiController() error {
 	return nil
 }
 
+func (c *SSHClientMock) CreateAgentConfig(file string, cfg BlueChiAgentConfig) (bool, error) {
+	return true, nil
+}
+
 func (c *SSHClientMock) RemoveAgentConfig(string) error {
 	return nil
 }
@@ -431,10 +1237,34 @@ func (c *SSHClientMock) RestartBlueChiAgent() error {
 	return nil
 }
 
+func (c *SSHClientMock) StartBlueChiAgent() error {
+	return nil
+}
+
 func (c *SSHClientMock) StopBlueChiAgent() error {
 	return nil
 }
 
+func (c *SSHClientMock) BackupFile(path string) (bool, error) {
+	return false, nil
+}
+
+func (c *SSHClientMock) RestoreFile(path string) error {
+	return nil
+}
+
+func (c *SSHClientMock) RemoveBackup(path string) error {
+	return nil
+}
+
+func (c *SSHClientMock) PreserveFile(path string) (string, error) {
+	return "", nil
+}
+
+func (c *SSHClientMock) RestorePreservedFile(path string, checksum string) error {
+	return nil
+}
+
 func NewSSHClientMock() Client {
 	return &SSHClientMock{}
 }
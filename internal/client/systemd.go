@@ -0,0 +1,65 @@
+package client
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	SystemdUnitDirectory string = "/etc/systemd/system/"
+
+	// ServiceOverridesFile is the name of the systemd drop-in written for the
+	// service overrides of a BlueChi service.
+	ServiceOverridesFile string = "terraform-provider-bluechi.conf"
+
+	// DefaultControllerPort is the port the BlueChi controller listens on
+	// if none is configured.
+	DefaultControllerPort int64 = 842
+
+	onlinePollInterval = 2 * time.Second
+
+	// serviceLogLines is the number of journal entries attached to errors
+	// of failed service operations
+	serviceLogLines = 20
+
+	// systemctlUnitNotLoaded is the exit status of systemctl for unknown units
+	systemctlUnitNotLoaded = 5
+)
+
+// ServiceOverridesDirectory returns the systemd drop-in directory of the
+// given service.
+func ServiceOverridesDirectory(service string) string {
+	return SystemdUnitDirectory + service + ".d/"
+}
+
+// ServiceOverrides are settings of the [Service] section of a systemd unit
+// which are applied on top of the unit file shipped by the package.
+type ServiceOverrides struct {
+	Restart     *string
+	MemoryMax   *string
+	CPUAffinity *string
+	Environment map[string]string
+}
+
+func (o ServiceOverrides) Serialize() string {
+	entries := []configEntry{}
+	entries = appendString(entries, "Restart", o.Restart)
+	entries = appendString(entries, "MemoryMax", o.MemoryMax)
+	entries = appendString(entries, "CPUAffinity", o.CPUAffinity)
+
+	res := "[Service]\n"
+	for _, entry := range entries {
+		res += entry.Key + "=" + entry.Value + "\n"
+	}
+	for _, entry := range appendExtraOptions([]configEntry{}, o.Environment) {
+		res += "Environment=" + quoteEnvironment(entry.Key+"="+entry.Value) + "\n"
+	}
+	return res
+}
+
+// quoteEnvironment quotes an assignment so that systemd keeps whitespace
+// and special characters of the value.
+func quoteEnvironment(assignment string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `%`, `%%`).Replace(assignment)
+	return `"` + escaped + `"`
+}
@@ -2,23 +2,77 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/engelmi/terraform-provider-bluechi/internal/client"
-	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/listvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/mapvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/setvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
 	"github.com/hashicorp/terraform-plugin-framework/diag"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/identityschema"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/booldefault"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64default"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringdefault"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
 	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
 	"github.com/hashicorp/terraform-plugin-log/tflog"
 )
 
+const (
+	serviceStateRunning string = "running"
+	serviceStateStopped string = "stopped"
+)
+
+var (
+	logLevels  = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+	logTargets = []string{"stderr", "stderr-full", "journald"}
+
+	nodeNameRegex            = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	nodeNameRegexDescription = "must only contain letters, digits, '_', '.' and '-'"
+
+	versionRegex   = regexp.MustCompile(`^\d+(\.\d+){0,2}$`)
+	configKeyRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+	// BlueChi only loads drop-ins with the .conf suffix
+	configFileNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+\.conf$`)
+	configValueRegex    = regexp.MustCompile(`^[^\r\n]*$`)
+
+	repoFileNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+	coprRepoRegex     = regexp.MustCompile(`^@?[A-Za-z0-9_.-]+/[A-Za-z0-9_.+-]+$`)
+	gpgKeyRegex       = regexp.MustCompile(`^(https?://|/)[^\s]+$`)
+	localPackageRegex = regexp.MustCompile(`\.(rpm|deb)$`)
+
+	restartPolicies      = []string{"no", "always", "on-success", "on-failure", "on-abnormal", "on-abort", "on-watchdog"}
+	memoryMaxRegex       = regexp.MustCompile(`^(\d+[KMGT]?|\d+(\.\d+)?%|infinity)$`)
+	cpuAffinityRegex     = regexp.MustCompile(`^\d+(-\d+)?([ ,]\d+(-\d+)?)*$`)
+	environmentNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+const (
+	nodeIDSeparator string = "/"
+	// used in place of the node name for nodes without an agent, the '@'
+	// can't be part of a node name
+	controllerNodeIDMarker string = "@controller"
+)
+
 var _ resource.Resource = &BlueChiNodeResource{}
 var _ resource.ResourceWithImportState = &BlueChiNodeResource{}
+var _ resource.ResourceWithModifyPlan = &BlueChiNodeResource{}
+var _ resource.ResourceWithIdentity = &BlueChiNodeResource{}
 
 func NewBlueChiNodeResource() resource.Resource {
 	return &BlueChiNodeResource{}
@@ -29,68 +83,388 @@ type BlueChiNodeResource struct {
 }
 
 type BlueChiNodeResourceModel struct {
-	Id                types.String            `tfsdk:"id"`
-	SSH               BlueChiSSHModel         `tfsdk:"ssh"`
-	BlueChiController *BlueChiControllerModel `tfsdk:"bluechi_controller"`
-	BlueChiAgent      *BlueChiAgentModel      `tfsdk:"bluechi_agent"`
+	Id                 types.String            `tfsdk:"id"`
+	SSH                BlueChiSSHModel         `tfsdk:"ssh"`
+	PackageSource      *PackageSourceModel     `tfsdk:"package_source"`
+	LocalPackages      types.List              `tfsdk:"local_packages"`
+	Components         types.Set               `tfsdk:"components"`
+	ImageMode          types.String            `tfsdk:"image_mode"`
+	RebootTimeout      types.Int64             `tfsdk:"reboot_timeout"`
+	PackageVersions    types.Map               `tfsdk:"package_versions"`
+	InstalledPackages  types.Set               `tfsdk:"installed_packages"`
+	BlueChiVersion     types.String            `tfsdk:"bluechi_version"`
+	DetectedVersion    types.String            `tfsdk:"detected_bluechi_version"`
+	UninstallOnDestroy types.Bool              `tfsdk:"uninstall_on_destroy"`
+	ForceDestroy       types.Bool              `tfsdk:"force_destroy"`
+	BlueChiController  *BlueChiControllerModel `tfsdk:"bluechi_controller"`
+	BlueChiAgent       *BlueChiAgentModel      `tfsdk:"bluechi_agent"`
+}
+
+type BlueChiNodeIdentityModel struct {
+	Host     types.String `tfsdk:"host"`
+	NodeName types.String `tfsdk:"node_name"`
 }
 
 type BlueChiSSHModel struct {
 	Host                  types.String `tfsdk:"host"`
 	User                  types.String `tfsdk:"user"`
 	Password              types.String `tfsdk:"password"`
+	PasswordWO            types.String `tfsdk:"password_wo"`
+	PasswordWOVersion     types.Int64  `tfsdk:"password_wo_version"`
 	PrivateKeyPath        types.String `tfsdk:"private_key_path"`
 	AcceptHostKeyInsecure types.Bool   `tfsdk:"accept_host_key_insecure"`
 }
 
+// HasStoredCredentials reports whether the state holds a way to log in to the
+// machine, which is not the case if only the write-only password is used.
+func (m BlueChiSSHModel) HasStoredCredentials() bool {
+	return !m.Password.IsNull() || !m.PrivateKeyPath.IsNull()
+}
+
+// ReadWriteOnlyPassword copies the write-only password from the config, since
+// it is always null in the plan and state.
+func (m *BlueChiSSHModel) ReadWriteOnlyPassword(ctx context.Context, config tfsdk.Config) diag.Diagnostics {
+	return config.GetAttribute(ctx, path.Root("ssh").AtName("password_wo"), &m.PasswordWO)
+}
+
+func writeOnlyOr(writeOnly types.String, value types.String) string {
+	if !writeOnly.IsNull() {
+		return writeOnly.ValueString()
+	}
+	return value.ValueString()
+}
+
+func (m BlueChiNodeResourceModel) InstallConfig(installCtrl bool, installAgent bool, components []string) client.InstallConfig {
+	cfg := client.InstallConfig{
+		Controller:    installCtrl,
+		Agent:         installAgent,
+		Components:    components,
+		ImageMode:     m.ImageMode.ValueString(),
+		RebootTimeout: time.Duration(m.RebootTimeout.ValueInt64()) * time.Second,
+	}
+	if m.PackageSource != nil {
+		cfg.Proxy = m.PackageSource.Proxy.ValueStringPointer()
+	}
+	m.LocalPackages.ElementsAs(context.Background(), &cfg.LocalPackages, true)
+
+	return cfg
+}
+
+// Version returns the BlueChi version the configuration is rendered for,
+// which is either the configured or the detected version.
+func (m BlueChiNodeResourceModel) Version() *client.BlueChiVersion {
+	for _, version := range []types.String{m.BlueChiVersion, m.DetectedVersion} {
+		if version.IsNull() || version.IsUnknown() {
+			continue
+		}
+		if parsed, err := client.ParseBlueChiVersion(version.ValueString()); err == nil {
+			return &parsed
+		}
+	}
+	return nil
+}
+
+// NodeID derives the id from the host and the name of the agent, which is
+// unknown as long as one of them is unknown.
+func (m BlueChiNodeResourceModel) NodeID() types.String {
+	identity := m.Identity()
+	if identity.Host.IsUnknown() || identity.NodeName.IsUnknown() {
+		return types.StringUnknown()
+	}
+	return types.StringValue(nodeID(identity.Host.ValueString(), identity.NodeName.ValueStringPointer()))
+}
+
+// Identity returns the resource identity, the node name is null for nodes
+// without an agent.
+func (m BlueChiNodeResourceModel) Identity() BlueChiNodeIdentityModel {
+	identity := BlueChiNodeIdentityModel{
+		Host:     m.SSH.Host,
+		NodeName: types.StringNull(),
+	}
+	if m.BlueChiAgent != nil {
+		identity.NodeName = m.BlueChiAgent.NodeName
+	}
+	return identity
+}
+
+func (m BlueChiNodeResourceModel) ControllerConfig() client.BlueChiControllerConfig {
+	cfg := m.BlueChiController.ToConfig(m.Version())
+	cfg.Owner = m.Id.ValueString()
+	return cfg
+}
+
+func (m BlueChiNodeResourceModel) AgentConfig() client.BlueChiAgentConfig {
+	cfg := m.BlueChiAgent.ToConfig(m.Version())
+	cfg.Owner = m.Id.ValueString()
+	return cfg
+}
+
+func (m BlueChiNodeResourceModel) ComponentList() []string {
+	components := []string{}
+	m.Components.ElementsAs(context.Background(), &components, true)
+	return components
+}
+
+// AddedPackages returns if the controller and agent roles are added compared
+// to the given state and which components are added.
+func (m BlueChiNodeResourceModel) AddedPackages(state BlueChiNodeResourceModel) (bool, bool, []string) {
+	installCtrl := state.BlueChiController == nil && m.BlueChiController != nil
+	installAgent := state.BlueChiAgent == nil && m.BlueChiAgent != nil
+
+	addedComponents := []string{}
+	for _, component := range m.ComponentList() {
+		if !slices.Contains(state.ComponentList(), component) {
+			addedComponents = append(addedComponents, component)
+		}
+	}
+
+	return installCtrl, installAgent, addedComponents
+}
+
+// InstallsPackages checks if an update from the given state installs
+// packages, which may change the BlueChi version on the machine.
+func (m BlueChiNodeResourceModel) InstallsPackages(state BlueChiNodeResourceModel) bool {
+	if m.Components.IsUnknown() {
+		return true
+	}
+	installCtrl, installAgent, addedComponents := m.AddedPackages(state)
+	return installCtrl || installAgent || len(addedComponents) > 0
+}
+
+// TrackedPackages returns all packages of the configured roles and
+// components for which the installed version is reported.
+func (m BlueChiNodeResourceModel) TrackedPackages() []string {
+	packages := []string{}
+	if m.BlueChiController != nil {
+		packages = append(packages, client.ControllerPackages...)
+	}
+	if m.BlueChiAgent != nil {
+		packages = append(packages, client.AgentPackages...)
+	}
+	return append(packages, m.ComponentList()...)
+}
+
+// RolePackages returns the packages of the given role which have been
+// installed by this resource.
+func (m BlueChiNodeResourceModel) RolePackages(rolePackages []string) []string {
+	installed := []string{}
+	m.InstalledPackages.ElementsAs(context.Background(), &installed, true)
+
+	packages := []string{}
+	for _, pkg := range installed {
+		if slices.Contains(rolePackages, pkg) {
+			packages = append(packages, pkg)
+		}
+	}
+	return packages
+}
+
+type PackageSourceModel struct {
+	RepoFiles        types.Map    `tfsdk:"repo_files"`
+	CoprRepos        types.Set    `tfsdk:"copr_repos"`
+	GPGKeys          types.Set    `tfsdk:"gpg_keys"`
+	Proxy            types.String `tfsdk:"proxy"`
+	ManagedRepoFiles types.Set    `tfsdk:"managed_repo_files"`
+	ManagedCoprRepos types.Set    `tfsdk:"managed_copr_repos"`
+	ManagedGPGKeys   types.Set    `tfsdk:"managed_gpg_keys"`
+}
+
+func (m PackageSourceModel) ToConfig() client.PackageSourceConfig {
+	cfg := client.PackageSourceConfig{}
+	m.RepoFiles.ElementsAs(context.Background(), &cfg.RepoFiles, true)
+	m.CoprRepos.ElementsAs(context.Background(), &cfg.CoprRepos, true)
+	m.GPGKeys.ElementsAs(context.Background(), &cfg.GPGKeys, true)
+	cfg.Proxy = m.Proxy.ValueStringPointer()
+
+	return cfg
+}
+
+func (m PackageSourceModel) ToManaged() client.ManagedPackageSource {
+	managed := client.ManagedPackageSource{}
+	m.ManagedRepoFiles.ElementsAs(context.Background(), &managed.RepoFiles, true)
+	m.ManagedCoprRepos.ElementsAs(context.Background(), &managed.CoprRepos, true)
+	m.ManagedGPGKeys.ElementsAs(context.Background(), &managed.GPGKeys, true)
+
+	return managed
+}
+
+func (m *PackageSourceModel) SetManaged(managed client.ManagedPackageSource) diag.Diagnostics {
+	var diags, d diag.Diagnostics
+	m.ManagedRepoFiles, d = types.SetValueFrom(context.Background(), types.StringType, managed.RepoFiles)
+	diags.Append(d...)
+	m.ManagedCoprRepos, d = types.SetValueFrom(context.Background(), types.StringType, managed.CoprRepos)
+	diags.Append(d...)
+	m.ManagedGPGKeys, d = types.SetValueFrom(context.Background(), types.StringType, managed.GPGKeys)
+	diags.Append(d...)
+
+	return diags
+}
+
+// SameSource reports if both models configure the same package sources,
+// ignoring what has been tracked as managed.
+func (m *PackageSourceModel) SameSource(other *PackageSourceModel) bool {
+	if m == nil || other == nil {
+		return m == other
+	}
+	return m.RepoFiles.Equal(other.RepoFiles) &&
+		m.CoprRepos.Equal(other.CoprRepos) &&
+		m.GPGKeys.Equal(other.GPGKeys) &&
+		m.Proxy.Equal(other.Proxy)
+}
+
 type BlueChiControllerModel struct {
-	AllowedNodeNames types.Set    `tfsdk:"allowed_node_names"`
-	ManagerPort      types.Int64  `tfsdk:"manager_port"`
-	LogLevel         types.String `tfsdk:"log_level"`
-	LogTarget        types.String `tfsdk:"log_target"`
-	LogIsQuiet       types.Bool   `tfsdk:"log_is_quiet"`
-	ConfigFile       types.String `tfsdk:"config_file"`
+	AllowedNodeNames       types.Set              `tfsdk:"allowed_node_names"`
+	ManagerPort            types.Int64            `tfsdk:"manager_port"`
+	ControllerPort         types.Int64            `tfsdk:"controller_port"`
+	ControllerUseTCP       types.Bool             `tfsdk:"controller_use_tcp"`
+	ControllerUseUDS       types.Bool             `tfsdk:"controller_use_uds"`
+	HeartbeatInterval      types.Int64            `tfsdk:"heartbeat_interval"`
+	NodeHeartbeatThreshold types.Int64            `tfsdk:"node_heartbeat_threshold"`
+	TCPKeepAliveTime       types.Int64            `tfsdk:"tcp_keepalive_time"`
+	TCPKeepAliveInterval   types.Int64            `tfsdk:"tcp_keepalive_interval"`
+	TCPKeepAliveCount      types.Int64            `tfsdk:"tcp_keepalive_count"`
+	IPReceiveErrors        types.Bool             `tfsdk:"ip_receive_errors"`
+	LogLevel               types.String           `tfsdk:"log_level"`
+	LogTarget              types.String           `tfsdk:"log_target"`
+	LogIsQuiet             types.Bool             `tfsdk:"log_is_quiet"`
+	ExtraOptions           types.Map              `tfsdk:"extra_options"`
+	ConfigFileName         types.String           `tfsdk:"config_file_name"`
+	Priority               types.Int64            `tfsdk:"priority"`
+	Enabled                types.Bool             `tfsdk:"enabled"`
+	State                  types.String           `tfsdk:"state"`
+	WaitForOnline          types.Bool             `tfsdk:"wait_for_online"`
+	OnlineTimeout          types.Int64            `tfsdk:"online_timeout"`
+	ServiceOverrides       *ServiceOverridesModel `tfsdk:"service_overrides"`
+	ConfigFile             types.String           `tfsdk:"config_file"`
+	RenderedConfig         types.String           `tfsdk:"rendered_config"`
+	OriginalChecksum       types.String           `tfsdk:"original_config_checksum"`
+	EffectiveConfig        types.Map              `tfsdk:"effective_config"`
 }
 
-func (m BlueChiControllerModel) ToConfig() client.BlueChiControllerConfig {
-	cfg := client.BlueChiControllerConfig{}
+func (m BlueChiControllerModel) ToConfig(version *client.BlueChiVersion) client.BlueChiControllerConfig {
+	cfg := client.BlueChiControllerConfig{Version: version}
 	m.AllowedNodeNames.ElementsAs(context.Background(), &cfg.AllowedNodeNames, true)
 	cfg.ManagerPort = m.ManagerPort.ValueInt64Pointer()
+	cfg.ControllerPort = m.ControllerPort.ValueInt64Pointer()
+	cfg.ControllerUseTCP = m.ControllerUseTCP.ValueBoolPointer()
+	cfg.ControllerUseUDS = m.ControllerUseUDS.ValueBoolPointer()
+	cfg.HeartbeatInterval = m.HeartbeatInterval.ValueInt64Pointer()
+	cfg.NodeHeartbeatThreshold = m.NodeHeartbeatThreshold.ValueInt64Pointer()
+	cfg.TCPKeepAliveTime = m.TCPKeepAliveTime.ValueInt64Pointer()
+	cfg.TCPKeepAliveInterval = m.TCPKeepAliveInterval.ValueInt64Pointer()
+	cfg.TCPKeepAliveCount = m.TCPKeepAliveCount.ValueInt64Pointer()
+	cfg.IPReceiveErrors = m.IPReceiveErrors.ValueBoolPointer()
 	cfg.LogLevel = m.LogLevel.ValueStringPointer()
 	cfg.LogTarget = m.LogTarget.ValueStringPointer()
 	cfg.LogIsQuiet = m.LogIsQuiet.ValueBoolPointer()
+	m.ExtraOptions.ElementsAs(context.Background(), &cfg.ExtraOptions, true)
 
 	return cfg
 }
 
+func (m BlueChiControllerModel) FileName() string {
+	return configFileName(m.ConfigFileName, m.Priority, "ctrl")
+}
+
 type BlueChiAgentModel struct {
-	NodeName          types.String `tfsdk:"node_name"`
-	ManagerHost       types.String `tfsdk:"manager_host"`
-	ManagerPort       types.Int64  `tfsdk:"manager_port"`
-	ManagerAddress    types.String `tfsdk:"manager_address"`
-	HeartbeatInterval types.Int64  `tfsdk:"heartbeat_interval"`
-	LogLevel          types.String `tfsdk:"log_level"`
-	LogTarget         types.String `tfsdk:"log_target"`
-	LogIsQuiet        types.Bool   `tfsdk:"log_is_quiet"`
-	ConfigFile        types.String `tfsdk:"config_file"`
-}
-
-func (m BlueChiAgentModel) ToConfig() client.BlueChiAgentConfig {
-	cfg := client.BlueChiAgentConfig{}
+	NodeName                       types.String           `tfsdk:"node_name"`
+	ManagerHost                    types.String           `tfsdk:"manager_host"`
+	ManagerPort                    types.Int64            `tfsdk:"manager_port"`
+	ManagerAddress                 types.String           `tfsdk:"manager_address"`
+	ControllerHost                 types.String           `tfsdk:"controller_host"`
+	ControllerPort                 types.Int64            `tfsdk:"controller_port"`
+	ControllerAddress              types.String           `tfsdk:"controller_address"`
+	HeartbeatInterval              types.Int64            `tfsdk:"heartbeat_interval"`
+	ControllerHeartbeatThreshold   types.Int64            `tfsdk:"controller_heartbeat_threshold"`
+	ConnectionRetryCount           types.Int64            `tfsdk:"connection_retry_count"`
+	ConnectionRetryCountUntilQuiet types.Int64            `tfsdk:"connection_retry_count_until_quiet"`
+	TCPKeepAliveTime               types.Int64            `tfsdk:"tcp_keepalive_time"`
+	TCPKeepAliveInterval           types.Int64            `tfsdk:"tcp_keepalive_interval"`
+	TCPKeepAliveCount              types.Int64            `tfsdk:"tcp_keepalive_count"`
+	IPReceiveErrors                types.Bool             `tfsdk:"ip_receive_errors"`
+	LogLevel                       types.String           `tfsdk:"log_level"`
+	LogTarget                      types.String           `tfsdk:"log_target"`
+	LogIsQuiet                     types.Bool             `tfsdk:"log_is_quiet"`
+	ExtraOptions                   types.Map              `tfsdk:"extra_options"`
+	ConfigFileName                 types.String           `tfsdk:"config_file_name"`
+	Priority                       types.Int64            `tfsdk:"priority"`
+	Enabled                        types.Bool             `tfsdk:"enabled"`
+	State                          types.String           `tfsdk:"state"`
+	WaitForOnline                  types.Bool             `tfsdk:"wait_for_online"`
+	OnlineTimeout                  types.Int64            `tfsdk:"online_timeout"`
+	ServiceOverrides               *ServiceOverridesModel `tfsdk:"service_overrides"`
+	ConfigFile                     types.String           `tfsdk:"config_file"`
+	RenderedConfig                 types.String           `tfsdk:"rendered_config"`
+	OriginalChecksum               types.String           `tfsdk:"original_config_checksum"`
+	EffectiveConfig                types.Map              `tfsdk:"effective_config"`
+}
+
+func (m BlueChiAgentModel) ToConfig(version *client.BlueChiVersion) client.BlueChiAgentConfig {
+	cfg := client.BlueChiAgentConfig{Version: version}
 	cfg.NodeName = m.NodeName.ValueStringPointer()
 	cfg.ManagerHost = m.ManagerHost.ValueStringPointer()
 	cfg.ManagerPort = m.ManagerPort.ValueInt64Pointer()
 	cfg.ManagerAddress = m.ManagerAddress.ValueStringPointer()
+	cfg.ControllerHost = m.ControllerHost.ValueStringPointer()
+	cfg.ControllerPort = m.ControllerPort.ValueInt64Pointer()
+	cfg.ControllerAddress = m.ControllerAddress.ValueStringPointer()
 	cfg.HeartbeatInterval = m.HeartbeatInterval.ValueInt64Pointer()
+	cfg.ControllerHeartbeatThreshold = m.ControllerHeartbeatThreshold.ValueInt64Pointer()
+	cfg.ConnectionRetryCount = m.ConnectionRetryCount.ValueInt64Pointer()
+	cfg.ConnectionRetryCountUntilQuiet = m.ConnectionRetryCountUntilQuiet.ValueInt64Pointer()
+	cfg.TCPKeepAliveTime = m.TCPKeepAliveTime.ValueInt64Pointer()
+	cfg.TCPKeepAliveInterval = m.TCPKeepAliveInterval.ValueInt64Pointer()
+	cfg.TCPKeepAliveCount = m.TCPKeepAliveCount.ValueInt64Pointer()
+	cfg.IPReceiveErrors = m.IPReceiveErrors.ValueBoolPointer()
 	cfg.LogLevel = m.LogLevel.ValueStringPointer()
 	cfg.LogTarget = m.LogTarget.ValueStringPointer()
 	cfg.LogIsQuiet = m.LogIsQuiet.ValueBoolPointer()
+	m.ExtraOptions.ElementsAs(context.Background(), &cfg.ExtraOptions, true)
+
+	return cfg
+}
+
+func (m BlueChiAgentModel) FileName() string {
+	return configFileName(m.ConfigFileName, m.Priority, "agent")
+}
 
+type ServiceOverridesModel struct {
+	Restart     types.String `tfsdk:"restart"`
+	MemoryMax   types.String `tfsdk:"memory_max"`
+	CPUAffinity types.String `tfsdk:"cpu_affinity"`
+	Environment types.Map    `tfsdk:"environment"`
+	File        types.String `tfsdk:"file"`
+}
+
+func (m ServiceOverridesModel) ToConfig() client.ServiceOverrides {
+	cfg := client.ServiceOverrides{
+		Restart:     m.Restart.ValueStringPointer(),
+		MemoryMax:   m.MemoryMax.ValueStringPointer(),
+		CPUAffinity: m.CPUAffinity.ValueStringPointer(),
+	}
+	m.Environment.ElementsAs(context.Background(), &cfg.Environment, true)
 	return cfg
 }
 
 func (r *BlueChiNodeResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
 	resp.TypeName = req.ProviderTypeName + "_node"
+	// adding or removing the agent changes the node name of the identity
+	resp.ResourceBehavior.MutableIdentity = true
+}
+
+func (r *BlueChiNodeResource) IdentitySchema(ctx context.Context, req resource.IdentitySchemaRequest, resp *resource.IdentitySchemaResponse) {
+	resp.IdentitySchema = identityschema.Schema{
+		Attributes: map[string]identityschema.Attribute{
+			"host": identityschema.StringAttribute{
+				RequiredForImport: true,
+				Description:       "Host of the machine as used in the ssh block",
+			},
+			"node_name": identityschema.StringAttribute{
+				OptionalForImport: true,
+				Description:       "Name of the BlueChi agent, omitted for nodes without an agent",
+			},
+		},
+	}
 }
 
 func (r *BlueChiNodeResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
@@ -99,10 +473,7 @@ func (r *BlueChiNodeResource) Schema(ctx context.Context, req resource.SchemaReq
 		Attributes: map[string]schema.Attribute{
 			"id": schema.StringAttribute{
 				Computed:            true,
-				MarkdownDescription: "Unique identifier of the node",
-				PlanModifiers: []planmodifier.String{
-					stringplanmodifier.UseStateForUnknown(),
-				},
+				MarkdownDescription: "Identifier of the node in the form `<host>/<node_name>`, or `<host>/@controller` for nodes without an agent",
 			},
 
 			"ssh": schema.SingleNestedAttribute{
@@ -111,23 +482,60 @@ func (r *BlueChiNodeResource) Schema(ctx context.Context, req resource.SchemaReq
 				Attributes: map[string]schema.Attribute{
 					"host": schema.StringAttribute{
 						Required:    true,
-						Description: "Host of the machine",
-						Validators:  []validator.String{},
+						Description: "Host of the machine. Changing the host replaces the node, cleaning up the previous machine.",
+						Validators: []validator.String{
+							stringvalidator.LengthAtLeast(1),
+						},
+						PlanModifiers: []planmodifier.String{
+							stringplanmodifier.RequiresReplace(),
+						},
 					},
 					"user": schema.StringAttribute{
 						Required:    true,
 						Description: "User on the machine",
-						Validators:  []validator.String{},
+						Validators: []validator.String{
+							stringvalidator.LengthAtLeast(1),
+						},
 					},
 					"password": schema.StringAttribute{
 						Optional:    true,
+						Sensitive:   true,
 						Description: "Password to log in to the machine",
-						Validators:  []validator.String{},
+						Validators: []validator.String{
+							stringvalidator.ConflictsWith(
+								path.MatchRelative().AtParent().AtName("password_wo"),
+								path.MatchRelative().AtParent().AtName("private_key_path"),
+							),
+						},
+					},
+					"password_wo": schema.StringAttribute{
+						Optional:    true,
+						WriteOnly:   true,
+						Sensitive:   true,
+						Description: "Write-only password to log in to the machine, which is not stored in the state. Requires password_wo_version.",
+						Validators: []validator.String{
+							stringvalidator.AlsoRequires(path.MatchRelative().AtParent().AtName("password_wo_version")),
+						},
+					},
+					"password_wo_version": schema.Int64Attribute{
+						Optional: true,
+						MarkdownDescription: "Version of `password_wo`, change it to apply the node with a new password. " +
+							"The write-only password is only available during create and update. Refresh and destroy log in with " +
+							"`private_key_path` if it is set, otherwise the node is not refreshed and destroy requires `force_destroy`.",
+						Validators: []validator.Int64{
+							int64validator.AlsoRequires(path.MatchRelative().AtParent().AtName("password_wo")),
+						},
 					},
 					"private_key_path": schema.StringAttribute{
 						Optional:    true,
-						Description: "Path to the private key used for login",
-						Validators:  []validator.String{},
+						Description: "Path to the private key used for login. Can be combined with password_wo to log in on refresh and destroy.",
+						Validators: []validator.String{
+							stringvalidator.LengthAtLeast(1),
+							stringvalidator.AtLeastOneOf(
+								path.MatchRelative().AtParent().AtName("password"),
+								path.MatchRelative().AtParent().AtName("password_wo"),
+							),
+						},
 					},
 					"accept_host_key_insecure": schema.BoolAttribute{
 						Optional:    true,
@@ -135,6 +543,123 @@ func (r *BlueChiNodeResource) Schema(ctx context.Context, req resource.SchemaReq
 					},
 				},
 			},
+			"package_source": schema.SingleNestedAttribute{
+				Optional:    true,
+				Description: "Package sources to set up on the machine before BlueChi is installed",
+				Attributes: map[string]schema.Attribute{
+					"repo_files": schema.MapAttribute{
+						Optional:    true,
+						ElementType: types.StringType,
+						Description: "Repository definitions written to " + client.YumReposDirectory + ", keyed by the file name without the .repo suffix. Existing files are kept if they match the definition, otherwise the apply fails",
+						Validators: []validator.Map{
+							mapvalidator.KeysAre(
+								stringvalidator.RegexMatches(repoFileNameRegex, "must be a plain file name without the .repo suffix"),
+							),
+						},
+					},
+					"copr_repos": schema.SetAttribute{
+						Optional:    true,
+						ElementType: types.StringType,
+						Description: "COPR repositories to enable, e.g. @centos-automotive-sig/bluechi-snapshot",
+						Validators: []validator.Set{
+							setvalidator.ValueStringsAre(
+								stringvalidator.RegexMatches(coprRepoRegex, "must be of the form owner/project or @group/project"),
+							),
+						},
+					},
+					"gpg_keys": schema.SetAttribute{
+						Optional:    true,
+						ElementType: types.StringType,
+						Description: "URLs or paths on the machine of GPG keys to import",
+						Validators: []validator.Set{
+							setvalidator.ValueStringsAre(
+								stringvalidator.RegexMatches(gpgKeyRegex, "must be an http(s) URL or an absolute path"),
+							),
+						},
+					},
+					"proxy": schema.StringAttribute{
+						Optional:    true,
+						Description: "Proxy used by the package manager when installing packages",
+					},
+					"managed_repo_files": schema.SetAttribute{
+						Computed:    true,
+						ElementType: types.StringType,
+						Description: "Repository definitions created by the provider",
+					},
+					"managed_copr_repos": schema.SetAttribute{
+						Computed:    true,
+						ElementType: types.StringType,
+						Description: "COPR repositories enabled by the provider",
+					},
+					"managed_gpg_keys": schema.SetAttribute{
+						Computed:    true,
+						ElementType: types.StringType,
+						Description: "GPG keys imported by the provider",
+					},
+				},
+			},
+			"local_packages": schema.ListAttribute{
+				Optional:    true,
+				ElementType: types.StringType,
+				Description: "Paths to local RPM or DEB files which are uploaded and installed instead of using the package repositories of the machine",
+				Validators: []validator.List{
+					listvalidator.ValueStringsAre(stringvalidator.RegexMatches(localPackageRegex, "must be a .rpm or .deb file")),
+				},
+			},
+			"components": schema.SetAttribute{
+				Optional:    true,
+				ElementType: types.StringType,
+				Description: "Optional BlueChi packages to install in addition to the controller and agent, one of: " + strings.Join(client.ComponentPackages, ", "),
+				Validators: []validator.Set{
+					setvalidator.ValueStringsAre(stringvalidator.OneOf(client.ComponentPackages...)),
+				},
+			},
+			"image_mode": schema.StringAttribute{
+				Optional:    true,
+				Computed:    true,
+				Default:     stringdefault.StaticString(client.ImageModeVerify),
+				Description: "Handling of image based (rpm-ostree, bootc) machines: verify fails if BlueChi is missing in the image, layer installs the missing packages and reboots the machine",
+				Validators: []validator.String{
+					stringvalidator.OneOf(client.ImageModeVerify, client.ImageModeLayer),
+				},
+			},
+			"reboot_timeout": schema.Int64Attribute{
+				Optional:    true,
+				Computed:    true,
+				Default:     int64default.StaticInt64(600),
+				Description: "Time in seconds to wait for an image based machine to come back after layering packages",
+			},
+			"package_versions": schema.MapAttribute{
+				Computed:    true,
+				ElementType: types.StringType,
+				Description: "Installed versions of the BlueChi packages and components on the machine",
+			},
+			"installed_packages": schema.SetAttribute{
+				Computed:    true,
+				ElementType: types.StringType,
+				Description: "Packages installed on the machine by this resource",
+			},
+			"bluechi_version": schema.StringAttribute{
+				Optional:    true,
+				Description: "BlueChi version the configuration is rendered for. Overrides the version detected on the machine.",
+				Validators: []validator.String{
+					stringvalidator.RegexMatches(versionRegex, "must be a version like 0.8.0"),
+				},
+			},
+			"detected_bluechi_version": schema.StringAttribute{
+				Computed:    true,
+				Description: "BlueChi version detected on the machine",
+			},
+			"uninstall_on_destroy": schema.BoolAttribute{
+				Optional:    true,
+				Description: "Flag to indicate if the installed packages are removed again on destroy or when a role is removed from the node",
+			},
+			"force_destroy": schema.BoolAttribute{
+				Optional:    true,
+				Computed:    true,
+				Default:     booldefault.StaticBool(false),
+				Description: "Flag to remove the node from the state on destroy even if the machine can't be reached or cleaning it up fails",
+			},
 			"bluechi_controller": schema.SingleNestedAttribute{
 				Optional:    true,
 				Description: "BlueChi controller configuration used on the node",
@@ -143,31 +668,214 @@ func (r *BlueChiNodeResource) Schema(ctx context.Context, req resource.SchemaReq
 						Required:    true,
 						ElementType: types.StringType,
 						Description: "List of all allowed node names",
-						Validators:  []validator.Set{},
+						Validators: []validator.Set{
+							setvalidator.SizeAtLeast(1),
+							setvalidator.ValueStringsAre(
+								stringvalidator.RegexMatches(nodeNameRegex, nodeNameRegexDescription),
+							),
+						},
 					},
 					"manager_port": schema.Int64Attribute{
 						Optional:    true,
-						Description: "Port the manager is listening on",
-						Validators:  []validator.Int64{},
+						Description: "Port the manager is listening on. Replaced by controller_port in newer BlueChi versions.",
+						Validators: []validator.Int64{
+							int64validator.Between(1, 65535),
+							int64validator.ConflictsWith(path.MatchRelative().AtParent().AtName("controller_port")),
+						},
+					},
+					"controller_port": schema.Int64Attribute{
+						Optional:    true,
+						Description: "Port the controller is listening on for TCP connections of agents",
+						Validators: []validator.Int64{
+							int64validator.Between(1, 65535),
+						},
+					},
+					"controller_use_tcp": schema.BoolAttribute{
+						Optional:    true,
+						Description: "Flag to indicate if the controller accepts agent connections via TCP",
+					},
+					"controller_use_uds": schema.BoolAttribute{
+						Optional:    true,
+						Description: "Flag to indicate if the controller accepts local agent connections via unix domain socket",
+					},
+					"heartbeat_interval": schema.Int64Attribute{
+						Optional:    true,
+						Description: "The interval in ms in which the controller sends heartbeats to the agents, 0 disables it",
+						Validators: []validator.Int64{
+							int64validator.AtLeast(0),
+						},
+					},
+					"node_heartbeat_threshold": schema.Int64Attribute{
+						Optional:    true,
+						Description: "The time in ms after which a node is considered offline when no heartbeat was received, 0 disables it",
+						Validators: []validator.Int64{
+							int64validator.AtLeast(0),
+						},
+					},
+					"tcp_keepalive_time": schema.Int64Attribute{
+						Optional:    true,
+						Description: "Time in seconds a connection needs to be idle before TCP keepalive probes are sent",
+						Validators: []validator.Int64{
+							int64validator.AtLeast(1),
+						},
+					},
+					"tcp_keepalive_interval": schema.Int64Attribute{
+						Optional:    true,
+						Description: "Time in seconds between TCP keepalive probes",
+						Validators: []validator.Int64{
+							int64validator.AtLeast(1),
+						},
+					},
+					"tcp_keepalive_count": schema.Int64Attribute{
+						Optional:    true,
+						Description: "Number of unanswered TCP keepalive probes before the connection is dropped",
+						Validators: []validator.Int64{
+							int64validator.AtLeast(1),
+						},
+					},
+					"ip_receive_errors": schema.BoolAttribute{
+						Optional:    true,
+						Description: "Flag to indicate if extended reliable error message passing (IP_RECVERR) is enabled on the connections",
 					},
 					"log_level": schema.StringAttribute{
 						Optional:    true,
 						Description: "Log level used by BlueChi controller",
-						Validators:  []validator.String{},
+						Validators: []validator.String{
+							stringvalidator.OneOf(logLevels...),
+						},
 					},
 					"log_target": schema.StringAttribute{
 						Optional:    true,
 						Description: "Log target used by BlueChi controller",
-						Validators:  []validator.String{},
+						Validators: []validator.String{
+							stringvalidator.OneOf(logTargets...),
+						},
 					},
 					"log_is_quiet": schema.BoolAttribute{
 						Optional:    true,
 						Description: "Flag to indicate if logs are written",
 					},
+					"extra_options": schema.MapAttribute{
+						Optional:    true,
+						ElementType: types.StringType,
+						Description: "Additional configuration keys added to the BlueChi controller section as is, e.g. for keys not yet supported by the provider",
+						Validators: []validator.Map{
+							mapvalidator.KeysAre(
+								stringvalidator.RegexMatches(configKeyRegex, "must be a valid configuration key"),
+								stringvalidator.NoneOfCaseInsensitive(client.ControllerConfigKeys...),
+							),
+							mapvalidator.ValueStringsAre(
+								stringvalidator.RegexMatches(configValueRegex, "must not contain line breaks"),
+							),
+						},
+					},
+					"enabled": schema.BoolAttribute{
+						Optional:    true,
+						Computed:    true,
+						Default:     booldefault.StaticBool(true),
+						Description: "Flag to indicate if the BlueChi controller service is started at boot",
+					},
+					"state": schema.StringAttribute{
+						Optional:    true,
+						Computed:    true,
+						Default:     stringdefault.StaticString(serviceStateRunning),
+						Description: "State of the BlueChi controller service, either running or stopped",
+						Validators: []validator.String{
+							stringvalidator.OneOf(serviceStateRunning, serviceStateStopped),
+						},
+					},
+					"wait_for_online": schema.BoolAttribute{
+						Optional:    true,
+						Computed:    true,
+						Default:     booldefault.StaticBool(false),
+						Description: "Flag to wait after starting the BlueChi controller service until the controller port is listening",
+					},
+					"online_timeout": schema.Int64Attribute{
+						Optional:    true,
+						Computed:    true,
+						Default:     int64default.StaticInt64(60),
+						Description: "Time in seconds to wait for the BlueChi controller to come online",
+						Validators: []validator.Int64{
+							int64validator.AtLeast(1),
+						},
+					},
+					"service_overrides": schema.SingleNestedAttribute{
+						Optional:    true,
+						Description: "Settings applied on top of the bluechi-controller.service systemd unit via a drop-in",
+						Attributes: map[string]schema.Attribute{
+							"restart": schema.StringAttribute{
+								Optional:    true,
+								Description: "Restart policy of the service",
+								Validators: []validator.String{
+									stringvalidator.OneOf(restartPolicies...),
+								},
+							},
+							"memory_max": schema.StringAttribute{
+								Optional:    true,
+								Description: "Memory limit of the service, e.g. 512M or infinity",
+								Validators: []validator.String{
+									stringvalidator.RegexMatches(memoryMaxRegex, "must be a number of bytes with optional K, M, G or T suffix, a percentage or infinity"),
+								},
+							},
+							"cpu_affinity": schema.StringAttribute{
+								Optional:    true,
+								Description: "CPUs the service is allowed to run on, e.g. 0-3 6",
+								Validators: []validator.String{
+									stringvalidator.RegexMatches(cpuAffinityRegex, "must be a list of CPU indices or ranges"),
+								},
+							},
+							"environment": schema.MapAttribute{
+								Optional:    true,
+								ElementType: types.StringType,
+								Description: "Environment variables set for the service",
+								Validators: []validator.Map{
+									mapvalidator.KeysAre(
+										stringvalidator.RegexMatches(environmentNameRegex, "must be a valid environment variable name"),
+									),
+									mapvalidator.ValueStringsAre(
+										stringvalidator.RegexMatches(configValueRegex, "must not contain line breaks"),
+									),
+								},
+							},
+							"file": schema.StringAttribute{
+								Computed:    true,
+								Description: "The systemd drop-in file on the system",
+								Default:     stringdefault.StaticString(client.ServiceOverridesDirectory(client.BlueChiControllerService) + client.ServiceOverridesFile),
+							},
+						},
+					},
+					"config_file_name": schema.StringAttribute{
+						Optional:    true,
+						Description: "Name of the drop-in file the BlueChi controller configuration is written to",
+						Validators: []validator.String{
+							stringvalidator.RegexMatches(configFileNameRegex, "must be a plain file name ending with .conf"),
+							stringvalidator.ConflictsWith(path.MatchRelative().AtParent().AtName("priority")),
+						},
+					},
+					"priority": schema.Int64Attribute{
+						Optional:    true,
+						Description: "Priority of the drop-in file, used as two digit prefix of its name. Drop-ins are applied in lexical order.",
+						Validators: []validator.Int64{
+							int64validator.Between(0, 99),
+						},
+					},
 					"config_file": schema.StringAttribute{
 						Computed:    true,
 						Description: "The bluechi controller configuration file on the system",
 					},
+					"rendered_config": schema.StringAttribute{
+						Computed:    true,
+						Description: "Content of the bluechi controller configuration file as written to the system",
+					},
+					"original_config_checksum": schema.StringAttribute{
+						Computed:    true,
+						Description: "Checksum of the file found at the path of the configuration file before it was written, which is restored on destroy",
+					},
+					"effective_config": schema.MapAttribute{
+						Computed:    true,
+						ElementType: types.StringType,
+						Description: "Configuration the BlueChi controller ends up with after merging controller.conf and all drop-ins in controller.conf.d",
+					},
 				},
 			},
 			"bluechi_agent": schema.SingleNestedAttribute{
@@ -176,47 +884,270 @@ func (r *BlueChiNodeResource) Schema(ctx context.Context, req resource.SchemaReq
 				Attributes: map[string]schema.Attribute{
 					"node_name": schema.StringAttribute{
 						Required:    true,
-						Description: "Name of the BlueChi agent",
-						Validators:  []validator.String{},
+						Description: "Name of the BlueChi agent. Renaming the agent replaces the node, adding or removing the agent does not.",
+						Validators: []validator.String{
+							stringvalidator.RegexMatches(nodeNameRegex, nodeNameRegexDescription),
+						},
+						PlanModifiers: []planmodifier.String{
+							stringplanmodifier.RequiresReplaceIf(
+								requiresReplaceIfRenamed,
+								"Renaming an existing agent requires replacing the node.",
+								"Renaming an existing agent requires replacing the node.",
+							),
+						},
 					},
 					"manager_host": schema.StringAttribute{
-						Required:    true,
-						Description: "Host of the manager to connect to",
-						Validators:  []validator.String{},
+						Optional:    true,
+						Description: "Host of the manager to connect to. Replaced by controller_host in newer BlueChi versions.",
+						Validators: []validator.String{
+							stringvalidator.ConflictsWith(
+								path.MatchRelative().AtParent().AtName("controller_host"),
+								path.MatchRelative().AtParent().AtName("manager_address"),
+								path.MatchRelative().AtParent().AtName("controller_address"),
+							),
+						},
 					},
 					"manager_port": schema.Int64Attribute{
-						Required:    true,
-						Description: "Port of the manager to connect to",
-						Validators:  []validator.Int64{},
+						Optional:    true,
+						Description: "Port of the manager to connect to. Replaced by controller_port in newer BlueChi versions.",
+						Validators: []validator.Int64{
+							int64validator.Between(1, 65535),
+							int64validator.ConflictsWith(
+								path.MatchRelative().AtParent().AtName("controller_port"),
+								path.MatchRelative().AtParent().AtName("manager_address"),
+								path.MatchRelative().AtParent().AtName("controller_address"),
+							),
+						},
 					},
 					"manager_address": schema.StringAttribute{
 						Optional:    true,
-						Description: "Address of the manager to connect to. Replaces host and port.",
-						Validators:  []validator.String{},
+						Description: "Address of the manager to connect to. Replaces host and port. Replaced by controller_address in newer BlueChi versions.",
+						Validators: []validator.String{
+							stringvalidator.ConflictsWith(path.MatchRelative().AtParent().AtName("controller_address")),
+						},
+					},
+					"controller_host": schema.StringAttribute{
+						Optional:    true,
+						Description: "Host of the controller to connect to",
+						Validators: []validator.String{
+							stringvalidator.ConflictsWith(
+								path.MatchRelative().AtParent().AtName("manager_address"),
+								path.MatchRelative().AtParent().AtName("controller_address"),
+							),
+							stringvalidator.AtLeastOneOf(
+								path.MatchRelative().AtParent().AtName("manager_host"),
+								path.MatchRelative().AtParent().AtName("manager_address"),
+								path.MatchRelative().AtParent().AtName("controller_address"),
+							),
+						},
+					},
+					"controller_port": schema.Int64Attribute{
+						Optional:    true,
+						Description: "Port of the controller to connect to",
+						Validators: []validator.Int64{
+							int64validator.Between(1, 65535),
+							int64validator.ConflictsWith(
+								path.MatchRelative().AtParent().AtName("manager_address"),
+								path.MatchRelative().AtParent().AtName("controller_address"),
+							),
+						},
+					},
+					"controller_address": schema.StringAttribute{
+						Optional:    true,
+						Description: "Address of the controller to connect to in the form of a D-Bus address. Replaces host and port.",
 					},
 					"heartbeat_interval": schema.Int64Attribute{
 						Optional:    true,
 						Description: "The interval in ms in which the connection is tested",
-						Validators:  []validator.Int64{},
+						Validators: []validator.Int64{
+							int64validator.AtLeast(0),
+						},
+					},
+					"controller_heartbeat_threshold": schema.Int64Attribute{
+						Optional:    true,
+						Description: "The time in ms after which the controller is considered disconnected when no heartbeat was received, 0 disables it",
+						Validators: []validator.Int64{
+							int64validator.AtLeast(0),
+						},
+					},
+					"connection_retry_count": schema.Int64Attribute{
+						Optional:    true,
+						Description: "Number of attempts to reconnect to the controller",
+						Validators: []validator.Int64{
+							int64validator.AtLeast(0),
+						},
+					},
+					"connection_retry_count_until_quiet": schema.Int64Attribute{
+						Optional:    true,
+						Description: "Number of failed reconnect attempts after which they are no longer logged",
+						Validators: []validator.Int64{
+							int64validator.AtLeast(0),
+						},
+					},
+					"tcp_keepalive_time": schema.Int64Attribute{
+						Optional:    true,
+						Description: "Time in seconds a connection needs to be idle before TCP keepalive probes are sent",
+						Validators: []validator.Int64{
+							int64validator.AtLeast(1),
+						},
+					},
+					"tcp_keepalive_interval": schema.Int64Attribute{
+						Optional:    true,
+						Description: "Time in seconds between TCP keepalive probes",
+						Validators: []validator.Int64{
+							int64validator.AtLeast(1),
+						},
+					},
+					"tcp_keepalive_count": schema.Int64Attribute{
+						Optional:    true,
+						Description: "Number of unanswered TCP keepalive probes before the connection is dropped",
+						Validators: []validator.Int64{
+							int64validator.AtLeast(1),
+						},
+					},
+					"ip_receive_errors": schema.BoolAttribute{
+						Optional:    true,
+						Description: "Flag to indicate if extended reliable error message passing (IP_RECVERR) is enabled on the connection",
 					},
 					"log_level": schema.StringAttribute{
 						Optional:    true,
-						Description: "Log level used by BlueChi controller",
-						Validators:  []validator.String{},
+						Description: "Log level used by BlueChi agent",
+						Validators: []validator.String{
+							stringvalidator.OneOf(logLevels...),
+						},
 					},
 					"log_target": schema.StringAttribute{
 						Optional:    true,
-						Description: "Log target used by BlueChi controller",
-						Validators:  []validator.String{},
+						Description: "Log target used by BlueChi agent",
+						Validators: []validator.String{
+							stringvalidator.OneOf(logTargets...),
+						},
 					},
 					"log_is_quiet": schema.BoolAttribute{
 						Optional:    true,
 						Description: "Flag to indicate if logs are written",
 					},
+					"extra_options": schema.MapAttribute{
+						Optional:    true,
+						ElementType: types.StringType,
+						Description: "Additional configuration keys added to the BlueChi agent section as is, e.g. for keys not yet supported by the provider",
+						Validators: []validator.Map{
+							mapvalidator.KeysAre(
+								stringvalidator.RegexMatches(configKeyRegex, "must be a valid configuration key"),
+								stringvalidator.NoneOfCaseInsensitive(client.AgentConfigKeys...),
+							),
+							mapvalidator.ValueStringsAre(
+								stringvalidator.RegexMatches(configValueRegex, "must not contain line breaks"),
+							),
+						},
+					},
+					"enabled": schema.BoolAttribute{
+						Optional:    true,
+						Computed:    true,
+						Default:     booldefault.StaticBool(true),
+						Description: "Flag to indicate if the BlueChi agent service is started at boot",
+					},
+					"state": schema.StringAttribute{
+						Optional:    true,
+						Computed:    true,
+						Default:     stringdefault.StaticString(serviceStateRunning),
+						Description: "State of the BlueChi agent service, either running or stopped",
+						Validators: []validator.String{
+							stringvalidator.OneOf(serviceStateRunning, serviceStateStopped),
+						},
+					},
+					"wait_for_online": schema.BoolAttribute{
+						Optional:    true,
+						Computed:    true,
+						Default:     booldefault.StaticBool(false),
+						Description: "Flag to wait after starting the BlueChi agent service until the agent is online, using bluechi-is-online if installed",
+					},
+					"online_timeout": schema.Int64Attribute{
+						Optional:    true,
+						Computed:    true,
+						Default:     int64default.StaticInt64(60),
+						Description: "Time in seconds to wait for the BlueChi agent to come online",
+						Validators: []validator.Int64{
+							int64validator.AtLeast(1),
+						},
+					},
+					"service_overrides": schema.SingleNestedAttribute{
+						Optional:    true,
+						Description: "Settings applied on top of the bluechi-agent.service systemd unit via a drop-in",
+						Attributes: map[string]schema.Attribute{
+							"restart": schema.StringAttribute{
+								Optional:    true,
+								Description: "Restart policy of the service",
+								Validators: []validator.String{
+									stringvalidator.OneOf(restartPolicies...),
+								},
+							},
+							"memory_max": schema.StringAttribute{
+								Optional:    true,
+								Description: "Memory limit of the service, e.g. 512M or infinity",
+								Validators: []validator.String{
+									stringvalidator.RegexMatches(memoryMaxRegex, "must be a number of bytes with optional K, M, G or T suffix, a percentage or infinity"),
+								},
+							},
+							"cpu_affinity": schema.StringAttribute{
+								Optional:    true,
+								Description: "CPUs the service is allowed to run on, e.g. 0-3 6",
+								Validators: []validator.String{
+									stringvalidator.RegexMatches(cpuAffinityRegex, "must be a list of CPU indices or ranges"),
+								},
+							},
+							"environment": schema.MapAttribute{
+								Optional:    true,
+								ElementType: types.StringType,
+								Description: "Environment variables set for the service",
+								Validators: []validator.Map{
+									mapvalidator.KeysAre(
+										stringvalidator.RegexMatches(environmentNameRegex, "must be a valid environment variable name"),
+									),
+									mapvalidator.ValueStringsAre(
+										stringvalidator.RegexMatches(configValueRegex, "must not contain line breaks"),
+									),
+								},
+							},
+							"file": schema.StringAttribute{
+								Computed:    true,
+								Description: "The systemd drop-in file on the system",
+								Default:     stringdefault.StaticString(client.ServiceOverridesDirectory(client.BlueChiAgentService) + client.ServiceOverridesFile),
+							},
+						},
+					},
+					"config_file_name": schema.StringAttribute{
+						Optional:    true,
+						Description: "Name of the drop-in file the BlueChi agent configuration is written to",
+						Validators: []validator.String{
+							stringvalidator.RegexMatches(configFileNameRegex, "must be a plain file name ending with .conf"),
+							stringvalidator.ConflictsWith(path.MatchRelative().AtParent().AtName("priority")),
+						},
+					},
+					"priority": schema.Int64Attribute{
+						Optional:    true,
+						Description: "Priority of the drop-in file, used as two digit prefix of its name. Drop-ins are applied in lexical order.",
+						Validators: []validator.Int64{
+							int64validator.Between(0, 99),
+						},
+					},
 					"config_file": schema.StringAttribute{
 						Computed:    true,
 						Description: "The bluechi agent configuration file on the system",
 					},
+					"rendered_config": schema.StringAttribute{
+						Computed:    true,
+						Description: "Content of the bluechi agent configuration file as written to the system",
+					},
+					"original_config_checksum": schema.StringAttribute{
+						Computed:    true,
+						Description: "Checksum of the file found at the path of the configuration file before it was written, which is restored on destroy",
+					},
+					"effective_config": schema.MapAttribute{
+						Computed:    true,
+						ElementType: types.StringType,
+						Description: "Configuration the BlueChi agent ends up with after merging agent.conf and all drop-ins in agent.conf.d",
+					},
 				},
 			},
 		},
@@ -246,6 +1177,7 @@ func (r *BlueChiNodeResource) Create(ctx context.Context, req resource.CreateReq
 	var data BlueChiNodeResourceModel
 
 	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	resp.Diagnostics.Append(data.SSH.ReadWriteOnlyPassword(ctx, req.Config)...)
 	if resp.Diagnostics.HasError() {
 		tflog.Error(ctx, "Failed to read model")
 		return
@@ -259,58 +1191,194 @@ func (r *BlueChiNodeResource) Create(ctx context.Context, req resource.CreateReq
 	}
 	defer sshClient.Disconnect()
 
-	id, err := uuid.GenerateUUID()
-	if err != nil {
-		tflog.Error(ctx, "Failed to generate UUID for node")
-		resp.Diagnostics.AddError("Failed to generate UUID for node", err.Error())
-		return
+	data.Id = data.NodeID()
+	if resp.Identity != nil {
+		resp.Diagnostics.Append(resp.Identity.Set(ctx, data.Identity())...)
 	}
-	data.Id = types.StringValue(id)
 
+	// if a later step fails, everything set up so far is saved so that the
+	// resource is tainted and a retry or destroy knows what exists on the node
+	defer func() {
+		if resp.Diagnostics.HasError() {
+			resp.Diagnostics.Append(savePartialState(ctx, &resp.State, &data)...)
+		}
+	}()
+
+	var errs diag.Diagnostics
 	ctrlConf := data.BlueChiController
 	agentConf := data.BlueChiAgent
 
-	err = sshClient.InstallBlueChi(ctrlConf != nil, agentConf != nil)
-	if err != nil {
-		tflog.Error(ctx, "Failed to install BlueChi")
-		resp.Diagnostics.AddError(fmt.Sprintf("Failed to install BlueChi: %v", err), err.Error())
-		return
+	// the config files are already set in the plan, but they are only recorded
+	// once written, so that destroying a partially created node doesn't remove
+	// files it never wrote
+	if ctrlConf != nil {
+		ctrlConf.ConfigFile = types.StringNull()
+		ctrlConf.RenderedConfig = types.StringNull()
+	}
+	if agentConf != nil {
+		agentConf.ConfigFile = types.StringNull()
+		agentConf.RenderedConfig = types.StringNull()
+	}
+
+	if data.PackageSource != nil {
+		managed, err := sshClient.ConfigurePackageSource(data.PackageSource.ToConfig())
+		resp.Diagnostics.Append(data.PackageSource.SetManaged(managed)...)
+		if err != nil {
+			tflog.Error(ctx, "Failed to configure package sources")
+			resp.Diagnostics.AddError("Failed to configure package sources", err.Error())
+			return
+		}
+	}
+
+	installedPackages, err := sshClient.InstallBlueChi(data.InstallConfig(ctrlConf != nil, agentConf != nil, data.ComponentList()))
+	if err != nil {
+		tflog.Error(ctx, "Failed to install BlueChi")
+		resp.Diagnostics.AddError(fmt.Sprintf("Failed to install BlueChi: %v", err), err.Error())
+		return
+	}
+	data.InstalledPackages, errs = types.SetValueFrom(ctx, types.StringType, installedPackages)
+	resp.Diagnostics.Append(errs...)
+
+	packageVersions, err := sshClient.GetPackageVersions(data.TrackedPackages())
+	if err != nil {
+		tflog.Error(ctx, "Failed to determine package versions")
+		resp.Diagnostics.AddError("Failed to determine package versions", err.Error())
+		return
+	}
+	data.PackageVersions, errs = types.MapValueFrom(ctx, types.StringType, packageVersions)
+	resp.Diagnostics.Append(errs...)
+
+	versionDiags := detectBlueChiVersion(sshClient, &data)
+	resp.Diagnostics.Append(versionDiags...)
+	if versionDiags.HasError() {
+		tflog.Error(ctx, "Failed to detect BlueChi version")
+		return
 	}
 
 	if ctrlConf != nil {
-		ctrlConfFile := assembleConfigFileName("ctrl")
-		err := sshClient.CreateControllerConfig(ctrlConfFile, data.BlueChiController.ToConfig())
+		managed, errDiag := checkConfigConflicts(sshClient, client.BlueChiControllerConfdDirectory, ctrlConf.FileName(), data.Id.ValueString())
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		ctrlConfFile := ctrlConf.FileName()
+		ctrlConf.OriginalChecksum, errDiag = preserveOriginalConfig(sshClient, client.BlueChiControllerConfdDirectory+ctrlConfFile, managed)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		configChanged, err := sshClient.CreateControllerConfig(ctrlConfFile, data.ControllerConfig())
 		if err != nil {
+			// the file may have been partially written, the preserved original is restored on destroy
+			if !ctrlConf.OriginalChecksum.IsNull() {
+				ctrlConf.ConfigFile = types.StringValue(ctrlConfFile)
+			}
 			tflog.Error(ctx, "Failed to create controller config")
 			resp.Diagnostics.AddError("Failed to create controller config", err.Error())
 			return
 		}
 		data.BlueChiController.ConfigFile = types.StringValue(ctrlConfFile)
+		data.BlueChiController.RenderedConfig = types.StringValue(data.ControllerConfig().Serialize())
 
-		err = sshClient.RestartBlueChiController()
-		if err != nil {
-			tflog.Error(ctx, "Failed to start controller service")
-			resp.Diagnostics.AddError("Failed to start controller service", err.Error())
+		overridesChanged, errDiag := applyServiceOverrides(sshClient, client.BlueChiControllerService, ctrlConf.ServiceOverrides, nil)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		errDiag = applyControllerServiceState(sshClient, ctrlConf.Enabled, ctrlConf.State, configChanged || overridesChanged)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		errDiag = waitForControllerOnline(sshClient, ctrlConf)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		effectiveConfig, effective, errDiag := readEffectiveConfig(sshClient, client.BlueChiControllerConfigFile, client.BlueChiControllerConfdDirectory)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
 			return
 		}
+		data.BlueChiController.EffectiveConfig = effectiveConfig
+		resp.Diagnostics.Append(overriddenKeyWarnings(
+			"bluechi_controller",
+			effective.OverriddenKeys(client.BlueChiControllerConfdDirectory+data.BlueChiController.ConfigFile.ValueString(), keys(data.ControllerConfig().Values())),
+		)...)
 	}
 
 	if agentConf != nil {
-		agentConfFile := assembleConfigFileName("agent")
-		err := sshClient.CreateAgentConfig(agentConfFile, data.BlueChiAgent.ToConfig())
+		managed, errDiag := checkConfigConflicts(sshClient, client.BlueChiAgentConfdDirectory, agentConf.FileName(), data.Id.ValueString())
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		agentConfFile := agentConf.FileName()
+		agentConf.OriginalChecksum, errDiag = preserveOriginalConfig(sshClient, client.BlueChiAgentConfdDirectory+agentConfFile, managed)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		configChanged, err := sshClient.CreateAgentConfig(agentConfFile, data.AgentConfig())
 		if err != nil {
+			// the file may have been partially written, the preserved original is restored on destroy
+			if !agentConf.OriginalChecksum.IsNull() {
+				agentConf.ConfigFile = types.StringValue(agentConfFile)
+			}
 			tflog.Error(ctx, "Failed to create agent config")
 			resp.Diagnostics.AddError("Failed to create agent config", err.Error())
 			return
 		}
 		data.BlueChiAgent.ConfigFile = types.StringValue(agentConfFile)
+		data.BlueChiAgent.RenderedConfig = types.StringValue(data.AgentConfig().Serialize())
 
-		err = sshClient.RestartBlueChiAgent()
-		if err != nil {
-			tflog.Error(ctx, "Failed to start agent service")
-			resp.Diagnostics.AddError("Failed to start agent service", err.Error())
+		overridesChanged, errDiag := applyServiceOverrides(sshClient, client.BlueChiAgentService, agentConf.ServiceOverrides, nil)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		errDiag = applyAgentServiceState(sshClient, agentConf.Enabled, agentConf.State, configChanged || overridesChanged)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		errDiag = waitForAgentOnline(sshClient, agentConf)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
 			return
 		}
+
+		effectiveConfig, effective, errDiag := readEffectiveConfig(sshClient, client.BlueChiAgentConfigFile, client.BlueChiAgentConfdDirectory)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+		data.BlueChiAgent.EffectiveConfig = effectiveConfig
+		resp.Diagnostics.Append(overriddenKeyWarnings(
+			"bluechi_agent",
+			effective.OverriddenKeys(client.BlueChiAgentConfdDirectory+data.BlueChiAgent.ConfigFile.ValueString(), keys(data.AgentConfig().Values())),
+		)...)
 	}
 
 	tflog.Trace(ctx, "Setup BlueChi on machine completed")
@@ -327,20 +1395,116 @@ func (r *BlueChiNodeResource) Read(ctx context.Context, req resource.ReadRequest
 		return
 	}
 
+	// an imported node only knows its host and node name, the connection is
+	// filled in from the config by the next apply
+	if data.SSH.User.IsNull() {
+		tflog.Warn(ctx, "Skipping refresh of imported node without connection details")
+		if resp.Identity != nil {
+			resp.Diagnostics.Append(resp.Identity.Set(ctx, data.Identity())...)
+		}
+		return
+	}
+
+	// with only the write-only password the machine can't be reached, so
+	// the state is kept as it was written by the last create or update
+	if !data.SSH.HasStoredCredentials() {
+		tflog.Warn(ctx, "Skipping refresh of node without stored credentials")
+		if resp.Identity != nil {
+			resp.Diagnostics.Append(resp.Identity.Set(ctx, data.Identity())...)
+		}
+		return
+	}
+
+	sshClient, errDiag := setupSSHClient(data.SSH, r.UseMock.ValueBool())
+	if errDiag != nil {
+		tflog.Error(ctx, "Failed to connect via SSH")
+		resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+		return
+	}
+	defer sshClient.Disconnect()
+
+	versionDiags := detectBlueChiVersion(sshClient, &data)
+	resp.Diagnostics.Append(versionDiags...)
+	if versionDiags.HasError() {
+		tflog.Error(ctx, "Failed to detect BlueChi version")
+		return
+	}
+
+	if data.BlueChiController != nil {
+		status, err := sshClient.GetServiceStatus(client.BlueChiControllerService)
+		if err != nil {
+			tflog.Error(ctx, "Failed to read controller service status")
+			resp.Diagnostics.AddError("Failed to read controller service status", err.Error())
+			return
+		}
+		data.BlueChiController.Enabled = types.BoolValue(status.Enabled)
+		data.BlueChiController.State = types.StringValue(serviceStateFromStatus(status))
+
+		effectiveConfig, _, errDiag := readEffectiveConfig(sshClient, client.BlueChiControllerConfigFile, client.BlueChiControllerConfdDirectory)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+		data.BlueChiController.EffectiveConfig = effectiveConfig
+	}
+
+	if data.BlueChiAgent != nil {
+		status, err := sshClient.GetServiceStatus(client.BlueChiAgentService)
+		if err != nil {
+			tflog.Error(ctx, "Failed to read agent service status")
+			resp.Diagnostics.AddError("Failed to read agent service status", err.Error())
+			return
+		}
+		data.BlueChiAgent.Enabled = types.BoolValue(status.Enabled)
+		data.BlueChiAgent.State = types.StringValue(serviceStateFromStatus(status))
+
+		effectiveConfig, _, errDiag := readEffectiveConfig(sshClient, client.BlueChiAgentConfigFile, client.BlueChiAgentConfdDirectory)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+		data.BlueChiAgent.EffectiveConfig = effectiveConfig
+	}
+
 	// Save updated data into Terraform state
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+	if resp.Identity != nil {
+		resp.Diagnostics.Append(resp.Identity.Set(ctx, data.Identity())...)
+	}
 }
 
 func (r *BlueChiNodeResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
-	var data BlueChiNodeResourceModel
+	var data, state BlueChiNodeResourceModel
 
 	// Read Terraform plan data into the model
 	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+	resp.Diagnostics.Append(data.SSH.ReadWriteOnlyPassword(ctx, req.Config)...)
 
 	if resp.Diagnostics.HasError() {
 		return
 	}
 
+	// changing only what happens on destroy doesn't touch the machine, so that
+	// force_destroy can be enabled for a machine that is no longer reachable
+	onlyDestroyOptions, err := onlyDestroyOptionsChanged(req.Plan.Raw, req.State.Raw)
+	if err != nil {
+		tflog.Error(ctx, "Failed to compare plan and state")
+		resp.Diagnostics.AddError("Failed to compare plan and state", err.Error())
+		return
+	}
+	if onlyDestroyOptions {
+		state.ForceDestroy = data.ForceDestroy
+		state.UninstallOnDestroy = data.UninstallOnDestroy
+		resp.Diagnostics.Append(resp.State.Set(ctx, &state)...)
+		if resp.Identity != nil {
+			resp.Diagnostics.Append(resp.Identity.Set(ctx, state.Identity())...)
+		}
+		return
+	}
+
 	sshClient, errDiag := setupSSHClient(data.SSH, r.UseMock.ValueBool())
 	if errDiag != nil {
 		tflog.Error(ctx, "Failed to create and connect via SSH")
@@ -349,48 +1513,400 @@ func (r *BlueChiNodeResource) Update(ctx context.Context, req resource.UpdateReq
 	}
 	defer sshClient.Disconnect()
 
+	if data.PackageSource.SameSource(state.PackageSource) {
+		if data.PackageSource != nil {
+			data.PackageSource.ManagedRepoFiles = state.PackageSource.ManagedRepoFiles
+			data.PackageSource.ManagedCoprRepos = state.PackageSource.ManagedCoprRepos
+			data.PackageSource.ManagedGPGKeys = state.PackageSource.ManagedGPGKeys
+		}
+	} else {
+		if state.PackageSource != nil {
+			err := sshClient.RemovePackageSource(state.PackageSource.ToManaged())
+			if err != nil {
+				tflog.Error(ctx, "Failed to remove package sources")
+				resp.Diagnostics.AddError("Failed to remove package sources", err.Error())
+				return
+			}
+		}
+		if data.PackageSource != nil {
+			managed, err := sshClient.ConfigurePackageSource(data.PackageSource.ToConfig())
+			resp.Diagnostics.Append(data.PackageSource.SetManaged(managed)...)
+			if err != nil {
+				tflog.Error(ctx, "Failed to configure package sources")
+				resp.Diagnostics.AddError("Failed to configure package sources", err.Error())
+				return
+			}
+		}
+	}
+
+	installedPackages := []string{}
+	state.InstalledPackages.ElementsAs(ctx, &installedPackages, true)
+
+	if state.BlueChiController != nil && data.BlueChiController == nil {
+		if !state.BlueChiController.ConfigFile.IsNull() {
+			err := removeControllerConfig(sshClient, state.BlueChiController.ConfigFile.ValueString(), state.BlueChiController.OriginalChecksum)
+			if err != nil {
+				tflog.Error(ctx, "Failed to remove controller config")
+				resp.Diagnostics.AddError("Failed to remove controller config", err.Error())
+				return
+			}
+		}
+
+		err := sshClient.StopBlueChiController()
+		if err != nil {
+			tflog.Error(ctx, "Failed to stop controller service")
+			resp.Diagnostics.AddError("Failed to stop controller service", err.Error())
+			return
+		}
+
+		_, errDiag := applyServiceOverrides(sshClient, client.BlueChiControllerService, nil, state.BlueChiController.ServiceOverrides)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		if data.UninstallOnDestroy.ValueBool() {
+			ctrlPackages := state.RolePackages(client.ControllerPackages)
+			err = sshClient.UninstallPackages(ctrlPackages)
+			if err != nil {
+				tflog.Error(ctx, "Failed to uninstall controller packages")
+				resp.Diagnostics.AddError("Failed to uninstall controller packages", err.Error())
+				return
+			}
+			installedPackages = slices.DeleteFunc(installedPackages, func(pkg string) bool {
+				return slices.Contains(ctrlPackages, pkg)
+			})
+		}
+	}
+
+	if state.BlueChiAgent != nil && data.BlueChiAgent == nil {
+		if !state.BlueChiAgent.ConfigFile.IsNull() {
+			err := removeAgentConfig(sshClient, state.BlueChiAgent.ConfigFile.ValueString(), state.BlueChiAgent.OriginalChecksum)
+			if err != nil {
+				tflog.Error(ctx, "Failed to remove agent config")
+				resp.Diagnostics.AddError("Failed to remove agent config", err.Error())
+				return
+			}
+		}
+
+		err := sshClient.StopBlueChiAgent()
+		if err != nil {
+			tflog.Error(ctx, "Failed to stop agent service")
+			resp.Diagnostics.AddError("Failed to stop agent service", err.Error())
+			return
+		}
+
+		_, errDiag := applyServiceOverrides(sshClient, client.BlueChiAgentService, nil, state.BlueChiAgent.ServiceOverrides)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		if data.UninstallOnDestroy.ValueBool() {
+			agentPackages := state.RolePackages(client.AgentPackages)
+			err = sshClient.UninstallPackages(agentPackages)
+			if err != nil {
+				tflog.Error(ctx, "Failed to uninstall agent packages")
+				resp.Diagnostics.AddError("Failed to uninstall agent packages", err.Error())
+				return
+			}
+			installedPackages = slices.DeleteFunc(installedPackages, func(pkg string) bool {
+				return slices.Contains(agentPackages, pkg)
+			})
+		}
+	}
+
+	installCtrl, installAgent, addedComponents := data.AddedPackages(state)
+	removedComponents := []string{}
+	for _, component := range state.ComponentList() {
+		if !slices.Contains(data.ComponentList(), component) && slices.Contains(installedPackages, component) {
+			removedComponents = append(removedComponents, component)
+		}
+	}
+
+	if len(removedComponents) > 0 && data.UninstallOnDestroy.ValueBool() {
+		err := sshClient.UninstallPackages(removedComponents)
+		if err != nil {
+			tflog.Error(ctx, "Failed to uninstall components")
+			resp.Diagnostics.AddError("Failed to uninstall components", err.Error())
+			return
+		}
+		installedPackages = slices.DeleteFunc(installedPackages, func(pkg string) bool {
+			return slices.Contains(removedComponents, pkg)
+		})
+	}
+
+	if installCtrl || installAgent || len(addedComponents) > 0 {
+		newPackages, err := sshClient.InstallBlueChi(data.InstallConfig(installCtrl, installAgent, addedComponents))
+		if err != nil {
+			tflog.Error(ctx, "Failed to install BlueChi")
+			resp.Diagnostics.AddError(fmt.Sprintf("Failed to install BlueChi: %v", err), err.Error())
+			return
+		}
+		for _, pkg := range newPackages {
+			if !slices.Contains(installedPackages, pkg) {
+				installedPackages = append(installedPackages, pkg)
+			}
+		}
+	}
+
+	var errs diag.Diagnostics
+	data.InstalledPackages, errs = types.SetValueFrom(ctx, types.StringType, installedPackages)
+	resp.Diagnostics.Append(errs...)
+
+	packageVersions, err := sshClient.GetPackageVersions(data.TrackedPackages())
+	if err != nil {
+		tflog.Error(ctx, "Failed to determine package versions")
+		resp.Diagnostics.AddError("Failed to determine package versions", err.Error())
+		return
+	}
+	data.PackageVersions, errs = types.MapValueFrom(ctx, types.StringType, packageVersions)
+	resp.Diagnostics.Append(errs...)
+
+	versionDiags := detectBlueChiVersion(sshClient, &data)
+	resp.Diagnostics.Append(versionDiags...)
+	if versionDiags.HasError() {
+		tflog.Error(ctx, "Failed to detect BlueChi version")
+		return
+	}
+
 	ctrlConf := data.BlueChiController
 	if ctrlConf != nil {
-		err := sshClient.CreateControllerConfig(
-			data.BlueChiController.ConfigFile.ValueString(),
-			data.BlueChiController.ToConfig(),
+		managed, errDiag := checkConfigConflicts(sshClient, client.BlueChiControllerConfdDirectory, ctrlConf.FileName(), data.Id.ValueString(), state.Id.ValueString())
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		// the previous config is kept until the service is known to work with the new one
+		previousFile := ""
+		if state.BlueChiController != nil {
+			backedUp, err := sshClient.BackupFile(client.BlueChiControllerConfdDirectory + state.BlueChiController.ConfigFile.ValueString())
+			if err != nil {
+				tflog.Error(ctx, "Failed to back up previous controller config")
+				resp.Diagnostics.AddError("Failed to back up previous controller config", err.Error())
+				return
+			}
+			if backedUp {
+				previousFile = state.BlueChiController.ConfigFile.ValueString()
+			}
+		}
+
+		if state.BlueChiController != nil && state.BlueChiController.ConfigFile.ValueString() == ctrlConf.FileName() {
+			ctrlConf.OriginalChecksum = state.BlueChiController.OriginalChecksum
+		} else {
+			ctrlConf.OriginalChecksum, errDiag = preserveOriginalConfig(sshClient, client.BlueChiControllerConfdDirectory+ctrlConf.FileName(), managed)
+			if errDiag != nil {
+				tflog.Error(ctx, errDiag.Summary())
+				resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+				return
+			}
+		}
+
+		ctrlConf.ConfigFile = types.StringValue(ctrlConf.FileName())
+		configChanged, err := sshClient.CreateControllerConfig(
+			ctrlConf.ConfigFile.ValueString(),
+			data.ControllerConfig(),
 		)
 		if err != nil {
 			tflog.Error(ctx, "Failed to update controller config")
 			resp.Diagnostics.AddError("Failed to update controller config", err.Error())
 			return
 		}
+		ctrlConf.RenderedConfig = types.StringValue(data.ControllerConfig().Serialize())
 
-		err = sshClient.RestartBlueChiController()
-		if err != nil {
-			tflog.Error(ctx, "Failed to start controller service")
-			resp.Diagnostics.AddError("Failed to start controller service", err.Error())
+		if state.BlueChiController != nil && !state.BlueChiController.ConfigFile.IsNull() && !state.BlueChiController.ConfigFile.Equal(ctrlConf.ConfigFile) {
+			err = sshClient.RemoveControllerConfig(state.BlueChiController.ConfigFile.ValueString())
+			if err != nil {
+				tflog.Error(ctx, "Failed to remove previous controller config")
+				resp.Diagnostics.AddError("Failed to remove previous controller config", err.Error())
+				return
+			}
+			configChanged = true
+		}
+
+		var previousOverrides *ServiceOverridesModel
+		if state.BlueChiController != nil {
+			previousOverrides = state.BlueChiController.ServiceOverrides
+		}
+		overridesChanged, errDiag := applyServiceOverrides(sshClient, client.BlueChiControllerService, ctrlConf.ServiceOverrides, previousOverrides)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		errDiag = applyControllerServiceState(sshClient, ctrlConf.Enabled, ctrlConf.State, configChanged || overridesChanged)
+		if errDiag == nil {
+			errDiag = waitForControllerOnline(sshClient, ctrlConf)
+		}
+		if errDiag != nil && configChanged && previousFile != "" {
+			errDiag = rollbackControllerConfig(sshClient, errDiag, previousFile, ctrlConf.ConfigFile.ValueString(), ctrlConf.OriginalChecksum)
+		}
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		if previousFile != "" {
+			err = sshClient.RemoveBackup(client.BlueChiControllerConfdDirectory + previousFile)
+			if err != nil {
+				tflog.Error(ctx, "Failed to remove backup of previous controller config")
+				resp.Diagnostics.AddError("Failed to remove backup of previous controller config", err.Error())
+				return
+			}
+		}
+
+		// the original file at the previous path is restored once the renamed config works
+		if state.BlueChiController != nil && !state.BlueChiController.ConfigFile.IsNull() && !state.BlueChiController.ConfigFile.Equal(ctrlConf.ConfigFile) && !state.BlueChiController.OriginalChecksum.IsNull() {
+			err = sshClient.RestorePreservedFile(
+				client.BlueChiControllerConfdDirectory+state.BlueChiController.ConfigFile.ValueString(),
+				state.BlueChiController.OriginalChecksum.ValueString(),
+			)
+			if err != nil {
+				tflog.Error(ctx, "Failed to restore original controller config")
+				resp.Diagnostics.AddError("Failed to restore original controller config", err.Error())
+				return
+			}
+		}
+
+		effectiveConfig, effective, errDiag := readEffectiveConfig(sshClient, client.BlueChiControllerConfigFile, client.BlueChiControllerConfdDirectory)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
 			return
 		}
+		data.BlueChiController.EffectiveConfig = effectiveConfig
+		resp.Diagnostics.Append(overriddenKeyWarnings(
+			"bluechi_controller",
+			effective.OverriddenKeys(client.BlueChiControllerConfdDirectory+data.BlueChiController.ConfigFile.ValueString(), keys(data.ControllerConfig().Values())),
+		)...)
 	}
 
 	agentConf := data.BlueChiAgent
 	if agentConf != nil {
-		err := sshClient.CreateAgentConfig(
-			data.BlueChiAgent.ConfigFile.ValueString(),
-			data.BlueChiAgent.ToConfig(),
+		managed, errDiag := checkConfigConflicts(sshClient, client.BlueChiAgentConfdDirectory, agentConf.FileName(), data.Id.ValueString(), state.Id.ValueString())
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		// the previous config is kept until the service is known to work with the new one
+		previousFile := ""
+		if state.BlueChiAgent != nil {
+			backedUp, err := sshClient.BackupFile(client.BlueChiAgentConfdDirectory + state.BlueChiAgent.ConfigFile.ValueString())
+			if err != nil {
+				tflog.Error(ctx, "Failed to back up previous agent config")
+				resp.Diagnostics.AddError("Failed to back up previous agent config", err.Error())
+				return
+			}
+			if backedUp {
+				previousFile = state.BlueChiAgent.ConfigFile.ValueString()
+			}
+		}
+
+		if state.BlueChiAgent != nil && state.BlueChiAgent.ConfigFile.ValueString() == agentConf.FileName() {
+			agentConf.OriginalChecksum = state.BlueChiAgent.OriginalChecksum
+		} else {
+			agentConf.OriginalChecksum, errDiag = preserveOriginalConfig(sshClient, client.BlueChiAgentConfdDirectory+agentConf.FileName(), managed)
+			if errDiag != nil {
+				tflog.Error(ctx, errDiag.Summary())
+				resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+				return
+			}
+		}
+
+		agentConf.ConfigFile = types.StringValue(agentConf.FileName())
+		configChanged, err := sshClient.CreateAgentConfig(
+			agentConf.ConfigFile.ValueString(),
+			data.AgentConfig(),
 		)
 		if err != nil {
 			tflog.Error(ctx, "Failed to update agent config")
 			resp.Diagnostics.AddError("Failed to update agent config", err.Error())
 			return
 		}
+		agentConf.RenderedConfig = types.StringValue(data.AgentConfig().Serialize())
 
-		err = sshClient.RestartBlueChiAgent()
-		if err != nil {
-			tflog.Error(ctx, "Failed to start agent service")
-			resp.Diagnostics.AddError("Failed to start agent service", err.Error())
+		if state.BlueChiAgent != nil && !state.BlueChiAgent.ConfigFile.IsNull() && !state.BlueChiAgent.ConfigFile.Equal(agentConf.ConfigFile) {
+			err = sshClient.RemoveAgentConfig(state.BlueChiAgent.ConfigFile.ValueString())
+			if err != nil {
+				tflog.Error(ctx, "Failed to remove previous agent config")
+				resp.Diagnostics.AddError("Failed to remove previous agent config", err.Error())
+				return
+			}
+			configChanged = true
+		}
+
+		var previousOverrides *ServiceOverridesModel
+		if state.BlueChiAgent != nil {
+			previousOverrides = state.BlueChiAgent.ServiceOverrides
+		}
+		overridesChanged, errDiag := applyServiceOverrides(sshClient, client.BlueChiAgentService, agentConf.ServiceOverrides, previousOverrides)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		errDiag = applyAgentServiceState(sshClient, agentConf.Enabled, agentConf.State, configChanged || overridesChanged)
+		if errDiag == nil {
+			errDiag = waitForAgentOnline(sshClient, agentConf)
+		}
+		if errDiag != nil && configChanged && previousFile != "" {
+			errDiag = rollbackAgentConfig(sshClient, errDiag, previousFile, agentConf.ConfigFile.ValueString(), agentConf.OriginalChecksum)
+		}
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+			return
+		}
+
+		if previousFile != "" {
+			err = sshClient.RemoveBackup(client.BlueChiAgentConfdDirectory + previousFile)
+			if err != nil {
+				tflog.Error(ctx, "Failed to remove backup of previous agent config")
+				resp.Diagnostics.AddError("Failed to remove backup of previous agent config", err.Error())
+				return
+			}
+		}
+
+		// the original file at the previous path is restored once the renamed config works
+		if state.BlueChiAgent != nil && !state.BlueChiAgent.ConfigFile.IsNull() && !state.BlueChiAgent.ConfigFile.Equal(agentConf.ConfigFile) && !state.BlueChiAgent.OriginalChecksum.IsNull() {
+			err = sshClient.RestorePreservedFile(
+				client.BlueChiAgentConfdDirectory+state.BlueChiAgent.ConfigFile.ValueString(),
+				state.BlueChiAgent.OriginalChecksum.ValueString(),
+			)
+			if err != nil {
+				tflog.Error(ctx, "Failed to restore original agent config")
+				resp.Diagnostics.AddError("Failed to restore original agent config", err.Error())
+				return
+			}
+		}
+
+		effectiveConfig, effective, errDiag := readEffectiveConfig(sshClient, client.BlueChiAgentConfigFile, client.BlueChiAgentConfdDirectory)
+		if errDiag != nil {
+			tflog.Error(ctx, errDiag.Summary())
+			resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
 			return
 		}
+		data.BlueChiAgent.EffectiveConfig = effectiveConfig
+		resp.Diagnostics.Append(overriddenKeyWarnings(
+			"bluechi_agent",
+			effective.OverriddenKeys(client.BlueChiAgentConfdDirectory+data.BlueChiAgent.ConfigFile.ValueString(), keys(data.AgentConfig().Values())),
+		)...)
 	}
 
 	tflog.Trace(ctx, "Setup BlueChi on machine updated")
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+	if resp.Identity != nil {
+		resp.Diagnostics.Append(resp.Identity.Set(ctx, data.Identity())...)
+	}
 }
 
 func (r *BlueChiNodeResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
@@ -401,51 +1917,238 @@ func (r *BlueChiNodeResource) Delete(ctx context.Context, req resource.DeleteReq
 		return
 	}
 
+	// errors are collected so that the remaining cleanup still takes place
+	diags := diag.Diagnostics{}
+	defer func() {
+		resp.Diagnostics.Append(forceDestroyDiagnostics(data.ForceDestroy, diags)...)
+	}()
+
+	if !data.SSH.HasStoredCredentials() {
+		tflog.Error(ctx, "No stored credentials to clean up the machine")
+		diags.AddError(
+			"No stored credentials to clean up the machine",
+			"The state holds no credentials to log in to the machine, since password_wo is not stored. "+
+				"Set private_key_path and apply to allow destroy to clean up the machine, "+
+				"or set force_destroy to remove the resource from the state without cleaning up the machine.",
+		)
+		return
+	}
+
 	sshClient, errDiag := setupSSHClient(data.SSH, r.UseMock.ValueBool())
-	if sshClient == nil {
+	if errDiag != nil {
 		tflog.Error(ctx, "Failed to connect via SSH")
-		resp.Diagnostics.AddError(errDiag.Summary(), errDiag.Detail())
+		diags.AddError(
+			errDiag.Summary(),
+			errDiag.Detail()+"\n\nSet force_destroy to remove the resource from the state without cleaning up the machine.",
+		)
 		return
 	}
 	defer sshClient.Disconnect()
 
-	ctrlConf := data.BlueChiController
-	if ctrlConf != nil {
-		err := sshClient.RemoveControllerConfig(ctrlConf.ConfigFile.ValueString())
+	if data.BlueChiController != nil {
+		diags.Append(cleanupController(ctx, sshClient, data.BlueChiController)...)
+	}
+
+	if data.BlueChiAgent != nil {
+		diags.Append(cleanupAgent(ctx, sshClient, data.BlueChiAgent)...)
+	}
+
+	if data.UninstallOnDestroy.ValueBool() {
+		installedPackages := []string{}
+		data.InstalledPackages.ElementsAs(ctx, &installedPackages, true)
+		err := sshClient.UninstallPackages(installedPackages)
 		if err != nil {
-			tflog.Error(ctx, "Failed to remove controller config")
-			resp.Diagnostics.AddError("Failed to remove controller config", err.Error())
-			return
+			tflog.Error(ctx, "Failed to uninstall packages")
+			diags.AddError("Failed to uninstall packages", err.Error())
 		}
+	}
 
-		err = sshClient.StopBlueChiController()
+	if data.PackageSource != nil {
+		err := sshClient.RemovePackageSource(data.PackageSource.ToManaged())
 		if err != nil {
-			tflog.Error(ctx, "Failed to stop controller service")
-			resp.Diagnostics.AddError("Failed to stop controller service", err.Error())
-			return
+			tflog.Error(ctx, "Failed to remove package sources")
+			diags.AddError("Failed to remove package sources", err.Error())
 		}
 	}
+}
 
-	agentConf := data.BlueChiAgent
-	if agentConf != nil {
-		err := sshClient.RemoveAgentConfig(agentConf.ConfigFile.ValueString())
-		if err != nil {
-			tflog.Error(ctx, "Failed to remove agent config")
-			resp.Diagnostics.AddError("Failed to remove agent config", err.Error())
+func (r *BlueChiNodeResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	// nothing to check if the resource is destroyed
+	if req.Plan.Raw.IsNull() {
+		return
+	}
+
+	var data BlueChiNodeResourceModel
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// the id changes along with the host and node name and is unknown until both are known
+	data.Id = data.NodeID()
+	resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("id"), data.Id)...)
+	if resp.Identity != nil && !data.Id.IsUnknown() {
+		resp.Diagnostics.Append(resp.Identity.Set(ctx, data.Identity())...)
+	}
+
+	// the config file name is known at plan time unless it depends on unknown values
+	if ctrl := data.BlueChiController; ctrl != nil && !ctrl.ConfigFileName.IsUnknown() && !ctrl.Priority.IsUnknown() {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("bluechi_controller").AtName("config_file"), ctrl.FileName())...)
+	}
+	if agent := data.BlueChiAgent; agent != nil && !agent.ConfigFileName.IsUnknown() && !agent.Priority.IsUnknown() {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("bluechi_agent").AtName("config_file"), agent.FileName())...)
+	}
+
+	if !req.State.Raw.IsNull() {
+		var state BlueChiNodeResourceModel
+		resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+		if resp.Diagnostics.HasError() {
 			return
 		}
 
-		err = sshClient.StopBlueChiAgent()
+		// installing packages may update BlueChi, so the version is only
+		// known if the update installs nothing
+		if data.DetectedVersion.IsUnknown() && !data.InstallsPackages(state) {
+			data.DetectedVersion = state.DetectedVersion
+			resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("detected_bluechi_version"), data.DetectedVersion)...)
+		}
+
+		// the replacement is marked by the plan modifiers of the attributes,
+		// the warnings explain what it means for the machines
+		if !data.SSH.Host.Equal(state.SSH.Host) {
+			resp.Diagnostics.AddAttributeWarning(
+				path.Root("ssh").AtName("host"),
+				"Node will be replaced",
+				fmt.Sprintf("The host changes from %s to %s. BlueChi is cleaned up on the previous machine and set up from scratch on the new one.", state.SSH.Host, data.SSH.Host),
+			)
+		}
+		if data.BlueChiAgent != nil && state.BlueChiAgent != nil && !data.BlueChiAgent.NodeName.Equal(state.BlueChiAgent.NodeName) {
+			resp.Diagnostics.AddAttributeWarning(
+				path.Root("bluechi_agent").AtName("node_name"),
+				"Node will be replaced",
+				fmt.Sprintf("The agent is renamed from %s to %s. The node is removed and set up again, so the agent registers with the controller under the new name.", state.BlueChiAgent.NodeName, data.BlueChiAgent.NodeName),
+			)
+		}
+
+		// the effective config in the state has been refreshed from the machine,
+		// values differing from the ones written by the provider are overridden
+		if data.BlueChiController != nil && state.BlueChiController != nil {
+			resp.Diagnostics.Append(overriddenKeyWarnings(
+				"bluechi_controller",
+				overriddenValues(state.ControllerConfig().Values(), state.BlueChiController.EffectiveConfig),
+			)...)
+		}
+		if data.BlueChiAgent != nil && state.BlueChiAgent != nil {
+			resp.Diagnostics.Append(overriddenKeyWarnings(
+				"bluechi_agent",
+				overriddenValues(state.AgentConfig().Values(), state.BlueChiAgent.EffectiveConfig),
+			)...)
+		}
+	}
+
+	// the rendered config is known at plan time if the id, the BlueChi version
+	// and all configured values of the role are known, the detected version
+	// is unknown if the update installs packages
+	renderable := !data.Id.IsUnknown() && !data.BlueChiVersion.IsUnknown() &&
+		(!data.BlueChiVersion.IsNull() || !data.DetectedVersion.IsUnknown())
+	if data.BlueChiController != nil && renderable && isFullyKnown(req.Config.Raw, "bluechi_controller") {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("bluechi_controller").AtName("rendered_config"), data.ControllerConfig().Serialize())...)
+	}
+	if data.BlueChiAgent != nil && renderable && isFullyKnown(req.Config.Raw, "bluechi_agent") {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("bluechi_agent").AtName("rendered_config"), data.AgentConfig().Serialize())...)
+	}
+
+	version := data.Version()
+	if version == nil {
+		return
+	}
+
+	if data.BlueChiController != nil {
+		for _, key := range data.BlueChiController.ToConfig(version).UnsupportedKeys() {
+			resp.Diagnostics.AddAttributeWarning(
+				path.Root("bluechi_controller"),
+				"Unsupported controller configuration key",
+				fmt.Sprintf("The key '%s' is not supported by BlueChi %s and will be ignored by the controller.", key, version),
+			)
+		}
+	}
+
+	if data.BlueChiAgent != nil {
+		for _, key := range data.BlueChiAgent.ToConfig(version).UnsupportedKeys() {
+			resp.Diagnostics.AddAttributeWarning(
+				path.Root("bluechi_agent"),
+				"Unsupported agent configuration key",
+				fmt.Sprintf("The key '%s' is not supported by BlueChi %s and will be ignored by the agent.", key, version),
+			)
+		}
+	}
+}
+
+func (r *BlueChiNodeResource) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
+	var identity BlueChiNodeIdentityModel
+	if req.ID != "" {
+		host, nodeName, err := parseNodeID(req.ID)
 		if err != nil {
-			tflog.Error(ctx, "Failed to stop agent service")
-			resp.Diagnostics.AddError("Failed to stop agent service", err.Error())
+			resp.Diagnostics.AddError("Invalid import id", err.Error())
+			return
+		}
+		identity.Host = types.StringValue(host)
+		identity.NodeName = types.StringPointerValue(nodeName)
+	} else {
+		resp.Diagnostics.Append(req.Identity.Get(ctx, &identity)...)
+		if resp.Diagnostics.HasError() {
 			return
 		}
+		if !identity.NodeName.IsNull() && !nodeNameRegex.MatchString(identity.NodeName.ValueString()) {
+			resp.Diagnostics.AddError(
+				"Invalid import identity",
+				fmt.Sprintf("The node name %s, got: %s", nodeNameRegexDescription, identity.NodeName.ValueString()),
+			)
+			return
+		}
+	}
+
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("id"), nodeID(identity.Host.ValueString(), identity.NodeName.ValueStringPointer()))...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("ssh").AtName("host"), identity.Host)...)
+	if !identity.NodeName.IsNull() {
+		resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("bluechi_agent").AtName("node_name"), identity.NodeName)...)
+	}
+	if resp.Identity != nil {
+		resp.Diagnostics.Append(resp.Identity.Set(ctx, identity)...)
 	}
 }
 
-func (r *BlueChiNodeResource) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
-	resource.ImportStatePassthroughID(ctx, path.Root("id"), req, resp)
+// requiresReplaceIfRenamed replaces the node if an existing agent gets a new
+// name, but not if the agent is added to or removed from the node.
+func requiresReplaceIfRenamed(ctx context.Context, req planmodifier.StringRequest, resp *stringplanmodifier.RequiresReplaceIfFuncResponse) {
+	resp.RequiresReplace = !req.StateValue.IsNull() && !req.PlanValue.IsNull()
+}
+
+// nodeID joins the host and the node name, or the controller marker if the
+// node has no agent.
+func nodeID(host string, nodeName *string) string {
+	if nodeName == nil {
+		return host + nodeIDSeparator + controllerNodeIDMarker
+	}
+	return host + nodeIDSeparator + *nodeName
+}
+
+// parseNodeID splits an id into the host and the node name, which is nil for
+// nodes without an agent.
+func parseNodeID(id string) (string, *string, error) {
+	idx := strings.LastIndex(id, nodeIDSeparator)
+	if idx <= 0 || idx == len(id)-1 {
+		return "", nil, fmt.Errorf("expected an id of the form '<host>/<node_name>' or '<host>/%s', got: %s", controllerNodeIDMarker, id)
+	}
+
+	host, name := id[:idx], id[idx+1:]
+	if name == controllerNodeIDMarker {
+		return host, nil, nil
+	}
+	if !nodeNameRegex.MatchString(name) {
+		return "", nil, fmt.Errorf("the node name in the id %s, got: %s", nodeNameRegexDescription, name)
+	}
+	return host, &name, nil
 }
 
 func setupSSHClient(sshModel BlueChiSSHModel, useMock bool) (client.Client, *diag.ErrorDiagnostic) {
@@ -454,7 +2157,7 @@ func setupSSHClient(sshModel BlueChiSSHModel, useMock bool) (client.Client, *dia
 		sshClient = client.NewSSHClient(
 			sshModel.Host.ValueString(),
 			sshModel.User.ValueString(),
-			sshModel.Password.ValueString(),
+			writeOnlyOr(sshModel.PasswordWO, sshModel.Password),
 			sshModel.PrivateKeyPath.ValueString(),
 			sshModel.AcceptHostKeyInsecure.ValueBool(),
 		)
@@ -469,6 +2172,471 @@ func setupSSHClient(sshModel BlueChiSSHModel, useMock bool) (client.Client, *dia
 	return sshClient, nil
 }
 
-func assembleConfigFileName(suffix string) string {
-	return fmt.Sprintf("ZZZ-%s.conf", suffix)
+// detectBlueChiVersion sets the detected version, which is null if BlueChi
+// isn't installed or its version can't be parsed. The config is then
+// rendered with the keys as configured.
+func detectBlueChiVersion(sshClient client.Client, data *BlueChiNodeResourceModel) diag.Diagnostics {
+	diags := diag.Diagnostics{}
+	data.DetectedVersion = types.StringNull()
+
+	version, err := sshClient.GetBlueChiVersion()
+	if errors.Is(err, client.ErrInvalidBlueChiVersion) {
+		diags.AddAttributeWarning(
+			path.Root("detected_bluechi_version"),
+			"Unknown BlueChi version",
+			fmt.Sprintf("%s. The configuration keys are rendered as configured, set bluechi_version to render them for a specific version.", err.Error()),
+		)
+		return diags
+	}
+	if err != nil {
+		diags.AddError("Failed to detect BlueChi version", err.Error())
+		return diags
+	}
+
+	if version != nil {
+		data.DetectedVersion = types.StringValue(version.String())
+	}
+
+	return diags
+}
+
+func serviceStateFromStatus(status client.ServiceStatus) string {
+	if status.Active {
+		return serviceStateRunning
+	}
+	return serviceStateStopped
+}
+
+// applyControllerServiceState restarts the running service only if its configuration
+// changed, otherwise it is merely started in case it is not running.
+func applyControllerServiceState(sshClient client.Client, enabled types.Bool, state types.String, restart bool) *diag.ErrorDiagnostic {
+	if state.ValueString() == serviceStateStopped {
+		if err := sshClient.StopBlueChiController(); err != nil {
+			diagnostic := diag.NewErrorDiagnostic("Failed to stop controller service", err.Error())
+			return &diagnostic
+		}
+	} else if restart {
+		if err := sshClient.RestartBlueChiController(); err != nil {
+			diagnostic := diag.NewErrorDiagnostic("Failed to restart controller service", err.Error())
+			return &diagnostic
+		}
+	} else {
+		if err := sshClient.StartBlueChiController(); err != nil {
+			diagnostic := diag.NewErrorDiagnostic("Failed to start controller service", err.Error())
+			return &diagnostic
+		}
+	}
+
+	if err := sshClient.SetServiceEnabled(client.BlueChiControllerService, enabled.ValueBool()); err != nil {
+		diagnostic := diag.NewErrorDiagnostic("Failed to change controller service enablement", err.Error())
+		return &diagnostic
+	}
+
+	return nil
+}
+
+// applyAgentServiceState restarts the running service only if its configuration
+// changed, otherwise it is merely started in case it is not running.
+func applyAgentServiceState(sshClient client.Client, enabled types.Bool, state types.String, restart bool) *diag.ErrorDiagnostic {
+	if state.ValueString() == serviceStateStopped {
+		if err := sshClient.StopBlueChiAgent(); err != nil {
+			diagnostic := diag.NewErrorDiagnostic("Failed to stop agent service", err.Error())
+			return &diagnostic
+		}
+	} else if restart {
+		if err := sshClient.RestartBlueChiAgent(); err != nil {
+			diagnostic := diag.NewErrorDiagnostic("Failed to restart agent service", err.Error())
+			return &diagnostic
+		}
+	} else {
+		if err := sshClient.StartBlueChiAgent(); err != nil {
+			diagnostic := diag.NewErrorDiagnostic("Failed to start agent service", err.Error())
+			return &diagnostic
+		}
+	}
+
+	if err := sshClient.SetServiceEnabled(client.BlueChiAgentService, enabled.ValueBool()); err != nil {
+		diagnostic := diag.NewErrorDiagnostic("Failed to change agent service enablement", err.Error())
+		return &diagnostic
+	}
+
+	return nil
+}
+
+// waitForControllerOnline waits until the controller listens on its TCP port,
+// or only until the service is active if TCP is disabled.
+func waitForControllerOnline(sshClient client.Client, ctrl *BlueChiControllerModel) *diag.ErrorDiagnostic {
+	if !ctrl.WaitForOnline.ValueBool() || ctrl.State.ValueString() == serviceStateStopped {
+		return nil
+	}
+
+	port := client.DefaultControllerPort
+	for _, configured := range []types.Int64{ctrl.ManagerPort, ctrl.ControllerPort} {
+		if !configured.IsNull() {
+			port = configured.ValueInt64()
+		}
+	}
+	if !ctrl.ControllerUseTCP.IsNull() && !ctrl.ControllerUseTCP.ValueBool() {
+		port = 0
+	}
+
+	err := sshClient.WaitForControllerOnline(port, time.Duration(ctrl.OnlineTimeout.ValueInt64())*time.Second)
+	if err != nil {
+		diagnostic := diag.NewErrorDiagnostic(
+			"BlueChi controller did not come online",
+			err.Error(),
+		)
+		return &diagnostic
+	}
+
+	return nil
+}
+
+func waitForAgentOnline(sshClient client.Client, agent *BlueChiAgentModel) *diag.ErrorDiagnostic {
+	if !agent.WaitForOnline.ValueBool() || agent.State.ValueString() == serviceStateStopped {
+		return nil
+	}
+
+	err := sshClient.WaitForAgentOnline(time.Duration(agent.OnlineTimeout.ValueInt64()) * time.Second)
+	if err != nil {
+		diagnostic := diag.NewErrorDiagnostic(
+			"BlueChi agent did not come online",
+			err.Error(),
+		)
+		return &diagnostic
+	}
+
+	return nil
+}
+
+// rollbackControllerConfig restores the previous config file from its backup
+// after the controller failed with the new one and restarts the controller.
+func rollbackControllerConfig(sshClient client.Client, failure *diag.ErrorDiagnostic, previousFile string, newFile string, newOriginalChecksum types.String) *diag.ErrorDiagnostic {
+	var err error
+	if newFile != previousFile {
+		err = removeControllerConfig(sshClient, newFile, newOriginalChecksum)
+	}
+	if err == nil {
+		err = sshClient.RestoreFile(client.BlueChiControllerConfdDirectory + previousFile)
+	}
+	if err == nil {
+		err = sshClient.RestartBlueChiController()
+	}
+	return rollbackDiagnostic("controller", failure, err)
+}
+
+func rollbackAgentConfig(sshClient client.Client, failure *diag.ErrorDiagnostic, previousFile string, newFile string, newOriginalChecksum types.String) *diag.ErrorDiagnostic {
+	var err error
+	if newFile != previousFile {
+		err = removeAgentConfig(sshClient, newFile, newOriginalChecksum)
+	}
+	if err == nil {
+		err = sshClient.RestoreFile(client.BlueChiAgentConfdDirectory + previousFile)
+	}
+	if err == nil {
+		err = sshClient.RestartBlueChiAgent()
+	}
+	return rollbackDiagnostic("agent", failure, err)
+}
+
+func rollbackDiagnostic(role string, failure *diag.ErrorDiagnostic, err error) *diag.ErrorDiagnostic {
+	if err != nil {
+		diagnostic := diag.NewErrorDiagnostic(
+			failure.Summary(),
+			fmt.Sprintf("%s\n\nRolling back to the previous %s configuration failed as well: %s", failure.Detail(), role, err.Error()),
+		)
+		return &diagnostic
+	}
+
+	diagnostic := diag.NewErrorDiagnostic(
+		fmt.Sprintf("%s, rolled back %s configuration", failure.Summary(), role),
+		fmt.Sprintf("%s\n\nThe previous %s configuration has been restored and the service restarted.", failure.Detail(), role),
+	)
+	return &diagnostic
+}
+
+// cleanupController removes the config and overrides of the controller and
+// stops it, continuing on errors to clean up as much as possible.
+func cleanupController(ctx context.Context, sshClient client.Client, ctrl *BlueChiControllerModel) diag.Diagnostics {
+	diags := diag.Diagnostics{}
+
+	// the config file is null if creating the node failed before writing it
+	if !ctrl.ConfigFile.IsNull() {
+		err := removeControllerConfig(sshClient, ctrl.ConfigFile.ValueString(), ctrl.OriginalChecksum)
+		if err != nil {
+			tflog.Error(ctx, "Failed to remove controller config")
+			diags.AddError("Failed to remove controller config", err.Error())
+		}
+	}
+
+	err := sshClient.StopBlueChiController()
+	if err != nil {
+		tflog.Error(ctx, "Failed to stop controller service")
+		diags.AddError("Failed to stop controller service", err.Error())
+	}
+
+	_, errDiag := applyServiceOverrides(sshClient, client.BlueChiControllerService, nil, ctrl.ServiceOverrides)
+	if errDiag != nil {
+		tflog.Error(ctx, errDiag.Summary())
+		diags.AddError(errDiag.Summary(), errDiag.Detail())
+	}
+
+	return diags
+}
+
+func cleanupAgent(ctx context.Context, sshClient client.Client, agent *BlueChiAgentModel) diag.Diagnostics {
+	diags := diag.Diagnostics{}
+
+	// the config file is null if creating the node failed before writing it
+	if !agent.ConfigFile.IsNull() {
+		err := removeAgentConfig(sshClient, agent.ConfigFile.ValueString(), agent.OriginalChecksum)
+		if err != nil {
+			tflog.Error(ctx, "Failed to remove agent config")
+			diags.AddError("Failed to remove agent config", err.Error())
+		}
+	}
+
+	err := sshClient.StopBlueChiAgent()
+	if err != nil {
+		tflog.Error(ctx, "Failed to stop agent service")
+		diags.AddError("Failed to stop agent service", err.Error())
+	}
+
+	_, errDiag := applyServiceOverrides(sshClient, client.BlueChiAgentService, nil, agent.ServiceOverrides)
+	if errDiag != nil {
+		tflog.Error(ctx, errDiag.Summary())
+		diags.AddError(errDiag.Summary(), errDiag.Detail())
+	}
+
+	return diags
+}
+
+// forceDestroyDiagnostics turns errors into warnings if force_destroy is set,
+// so that the resource is removed from the state anyway.
+func forceDestroyDiagnostics(force types.Bool, diags diag.Diagnostics) diag.Diagnostics {
+	if !force.ValueBool() {
+		return diags
+	}
+
+	res := diag.Diagnostics{}
+	for _, diagnostic := range diags {
+		if diagnostic.Severity() != diag.SeverityError {
+			res.Append(diagnostic)
+			continue
+		}
+		res.AddWarning(
+			diagnostic.Summary(),
+			diagnostic.Detail()+"\n\nThe resource has been removed from the state anyway since force_destroy is set.",
+		)
+	}
+	return res
+}
+
+// applyServiceOverrides writes the systemd drop-in of the service if overrides
+// are configured and removes a previously written one otherwise. It reports
+// whether the drop-in changed.
+func applyServiceOverrides(sshClient client.Client, service string, overrides *ServiceOverridesModel, previous *ServiceOverridesModel) (bool, *diag.ErrorDiagnostic) {
+	if overrides != nil {
+		changed, err := sshClient.CreateServiceOverrides(service, overrides.ToConfig())
+		if err != nil {
+			diagnostic := diag.NewErrorDiagnostic("Failed to create service overrides", err.Error())
+			return false, &diagnostic
+		}
+		return changed, nil
+	}
+
+	if previous != nil {
+		err := sshClient.RemoveServiceOverrides(service)
+		if err != nil {
+			diagnostic := diag.NewErrorDiagnostic("Failed to remove service overrides", err.Error())
+			return false, &diagnostic
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func configFileName(fileName types.String, priority types.Int64, suffix string) string {
+	if !fileName.IsNull() && !fileName.IsUnknown() {
+		return fileName.ValueString()
+	}
+	if !priority.IsNull() && !priority.IsUnknown() {
+		return assembleConfigFileName(fmt.Sprintf("%02d", priority.ValueInt64()), suffix)
+	}
+	return assembleConfigFileName("ZZZ", suffix)
+}
+
+func assembleConfigFileName(prefix string, suffix string) string {
+	return fmt.Sprintf("%s-%s.conf", prefix, suffix)
+}
+
+// savePartialState saves the model with all values which are still unknown
+// set to null, as the state must not contain unknown values.
+func savePartialState(ctx context.Context, state *tfsdk.State, data *BlueChiNodeResourceModel) diag.Diagnostics {
+	diags := state.Set(ctx, data)
+	if diags.HasError() {
+		return diags
+	}
+
+	raw, err := tftypes.Transform(state.Raw, func(_ *tftypes.AttributePath, value tftypes.Value) (tftypes.Value, error) {
+		if !value.IsKnown() {
+			return tftypes.NewValue(value.Type(), nil), nil
+		}
+		return value, nil
+	})
+	if err != nil {
+		diags.AddError("Failed to save partial state", err.Error())
+		return diags
+	}
+	state.Raw = raw
+
+	return diags
+}
+
+// onlyDestroyOptionsChanged reports whether the plan differs from the state in
+// nothing but the attributes only used on destroy. Unknown values in the plan
+// are computed ones and compared by their value in the state.
+func onlyDestroyOptionsChanged(plan tftypes.Value, state tftypes.Value) (bool, error) {
+	destroyOptions := []*tftypes.AttributePath{
+		tftypes.NewAttributePath().WithAttributeName("force_destroy"),
+		tftypes.NewAttributePath().WithAttributeName("uninstall_on_destroy"),
+	}
+
+	resolved, err := tftypes.Transform(plan, func(attrPath *tftypes.AttributePath, value tftypes.Value) (tftypes.Value, error) {
+		if value.IsKnown() && !slices.ContainsFunc(destroyOptions, attrPath.Equal) {
+			return value, nil
+		}
+		prior, _, err := tftypes.WalkAttributePath(state, attrPath)
+		if err != nil {
+			// not part of the state, the unknown value differs anyway
+			return value, nil
+		}
+		return prior.(tftypes.Value), nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return resolved.Equal(state), nil
+}
+
+// checkConfigConflicts fails if the config file is already managed by another
+// bluechi_node resource targeting the same machine. It reports whether the
+// file is already managed by this resource, which may have been written
+// under any of the given ids.
+func checkConfigConflicts(sshClient client.Client, dir string, file string, ids ...string) (bool, *diag.ErrorDiagnostic) {
+	managed, err := sshClient.ListManagedConfigs(dir)
+	if err != nil {
+		diagnostic := diag.NewErrorDiagnostic("Failed to check for conflicting config files", err.Error())
+		return false, &diagnostic
+	}
+
+	owner, found := managed[file]
+	if found && !slices.Contains(ids, owner) {
+		diagnostic := diag.NewErrorDiagnostic(
+			"Conflicting config file",
+			fmt.Sprintf("The file '%s' is managed by another bluechi_node resource (%s) on the same machine. Use config_file_name or priority to choose a different file.", dir+file, owner),
+		)
+		return false, &diagnostic
+	}
+
+	return found, nil
+}
+
+// preserveOriginalConfig keeps a copy of a file not written by the provider
+// at the path of the config file and returns its checksum, if there is one.
+func preserveOriginalConfig(sshClient client.Client, path string, managed bool) (types.String, *diag.ErrorDiagnostic) {
+	if managed {
+		return types.StringNull(), nil
+	}
+
+	checksum, err := sshClient.PreserveFile(path)
+	if err != nil {
+		diagnostic := diag.NewErrorDiagnostic("Failed to back up existing config file", err.Error())
+		return types.StringNull(), &diagnostic
+	}
+	if checksum == "" {
+		return types.StringNull(), nil
+	}
+	return types.StringValue(checksum), nil
+}
+
+// removeControllerConfig removes the config file written by the provider and
+// restores the file found at its path before, if there was one.
+func removeControllerConfig(sshClient client.Client, file string, originalChecksum types.String) error {
+	if originalChecksum.IsNull() || originalChecksum.IsUnknown() {
+		return sshClient.RemoveControllerConfig(file)
+	}
+	return sshClient.RestorePreservedFile(client.BlueChiControllerConfdDirectory+file, originalChecksum.ValueString())
+}
+
+func removeAgentConfig(sshClient client.Client, file string, originalChecksum types.String) error {
+	if originalChecksum.IsNull() || originalChecksum.IsUnknown() {
+		return sshClient.RemoveAgentConfig(file)
+	}
+	return sshClient.RestorePreservedFile(client.BlueChiAgentConfdDirectory+file, originalChecksum.ValueString())
+}
+
+func readEffectiveConfig(sshClient client.Client, mainFile string, dir string) (types.Map, client.EffectiveConfig, *diag.ErrorDiagnostic) {
+	effective, err := sshClient.GetEffectiveConfig(mainFile, dir)
+	if err != nil {
+		diagnostic := diag.NewErrorDiagnostic("Failed to read effective config", err.Error())
+		return types.MapNull(types.StringType), effective, &diagnostic
+	}
+
+	values := map[string]attr.Value{}
+	for key, value := range effective.Values {
+		values[key] = types.StringValue(value)
+	}
+	return types.MapValueMust(types.StringType, values), effective, nil
+}
+
+// overriddenValues returns the managed keys whose effective value differs
+// from the value written by the provider, mapped to a description of the
+// overriding value.
+func overriddenValues(managed map[string]string, effectiveConfig types.Map) map[string]string {
+	overridden := map[string]string{}
+	if effectiveConfig.IsNull() || effectiveConfig.IsUnknown() {
+		return overridden
+	}
+
+	effective := map[string]string{}
+	effectiveConfig.ElementsAs(context.Background(), &effective, false)
+	for key, value := range managed {
+		if effectiveValue, ok := effective[key]; ok && effectiveValue != value {
+			overridden[key] = fmt.Sprintf("the value '%s' of another config file", effectiveValue)
+		}
+	}
+	return overridden
+}
+
+func overriddenKeyWarnings(attribute string, overridden map[string]string) diag.Diagnostics {
+	diags := diag.Diagnostics{}
+	for _, key := range keys(overridden) {
+		diags.AddAttributeWarning(
+			path.Root(attribute),
+			"Configuration key overridden",
+			fmt.Sprintf("The key '%s' managed by this resource is overridden by %s.", key, overridden[key]),
+		)
+	}
+	return diags
+}
+
+func keys(m map[string]string) []string {
+	res := []string{}
+	for key := range m {
+		res = append(res, key)
+	}
+	slices.Sort(res)
+	return res
+}
+
+func isFullyKnown(raw tftypes.Value, attribute string) bool {
+	value, _, err := tftypes.WalkAttributePath(raw, tftypes.NewAttributePath().WithAttributeName(attribute))
+	if err != nil {
+		return false
+	}
+	known, ok := value.(tftypes.Value)
+	return ok && known.IsFullyKnown()
 }
@@ -1,9 +1,20 @@
 package provider_test
 
 import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
 	"testing"
 
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
 	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/knownvalue"
+	"github.com/hashicorp/terraform-plugin-testing/plancheck"
+	"github.com/hashicorp/terraform-plugin-testing/statecheck"
+	"github.com/hashicorp/terraform-plugin-testing/terraform"
+	"github.com/hashicorp/terraform-plugin-testing/tfjsonpath"
 )
 
 func TestBlueChiNodeResource(t *testing.T) {
@@ -19,6 +30,352 @@ func TestBlueChiNodeResource(t *testing.T) {
 	})
 }
 
+func TestBlueChiNodeResourceValidation(t *testing.T) {
+	resource.Test(t, resource.TestCase{
+		PreCheck:                 func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config:      validationConfig("bluechi_controller", `log_level = "VERBOSE"`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`value must be one of`),
+			},
+			{
+				Config:      validationConfig("bluechi_controller", `log_target = "syslog"`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`value must be one of`),
+			},
+			{
+				Config:      validationConfig("bluechi_controller", `manager_port = 99999`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`value must be between 1 and 65535`),
+			},
+			{
+				Config:      validationConfig("bluechi_agent", `node_name = "worker 1"`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`must only contain letters`),
+			},
+			{
+				Config:      validationConfig("bluechi_controller", `config_file_name = "../bluechi.conf"`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`must be a plain file name`),
+			},
+			{
+				Config: validationConfig("bluechi_agent", `node_name = "main"
+				priority = 100`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`value must be between 0 and 99`),
+			},
+			{
+				Config: validationConfig("bluechi_agent", `node_name = "main"
+				service_overrides = { memory_max = "lots" }`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`got: lots`),
+			},
+			{
+				Config: validationConfig("ssh", `password = "secret"
+				private_key_path = "~/.ssh/id_rsa"`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`Invalid Attribute Combination`),
+			},
+			{
+				Config:      validationConfig("ssh", ""),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`At least one attribute out of`),
+			},
+			{
+				Config: validationConfig("ssh", `private_key_path = "~/.ssh/id_rsa"
+				password_wo_version = 1`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`"ssh.password_wo" must be specified`),
+			},
+			{
+				Config:      validationConfig("package_source", `repo_files = { "../../etc/x" = "" }`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`got: ../../etc/x`),
+			},
+			{
+				Config:      validationConfig("package_source", `copr_repos = ["bluechi; reboot"]`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`got: bluechi; reboot`),
+			},
+			{
+				Config:      validationConfig("package_source", `gpg_keys = ["keys/RPM-GPG-KEY"]`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`got: keys/RPM-GPG-KEY`),
+			},
+			{
+				Config:      validationConfig("", `local_packages = ["./bluechi $(reboot)"]`),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`must be a .rpm or .deb file`),
+			},
+		},
+	})
+}
+
+func TestBlueChiNodeResourceDetectedVersion(t *testing.T) {
+	resource.Test(t, resource.TestCase{
+		PreCheck:                 func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: validationConfig("bluechi_agent", `node_name = "main"`),
+			},
+			{
+				Config: validationConfig("bluechi_agent", `node_name = "main"
+				log_level = "DEBUG"`),
+				ConfigPlanChecks: resource.ConfigPlanChecks{
+					PreApply: []plancheck.PlanCheck{
+						plancheck.ExpectKnownValue("bluechi_node.main", tfjsonpath.New("detected_bluechi_version"), knownvalue.Null()),
+						plancheck.ExpectKnownValue("bluechi_node.main", tfjsonpath.New("bluechi_agent").AtMapKey("rendered_config"), knownvalue.NotNull()),
+					},
+				},
+			},
+			{
+				Config: validationConfig("", `components = ["bluechi-is-online"]`),
+				ConfigPlanChecks: resource.ConfigPlanChecks{
+					PreApply: []plancheck.PlanCheck{
+						plancheck.ExpectUnknownValue("bluechi_node.main", tfjsonpath.New("detected_bluechi_version")),
+						plancheck.ExpectUnknownValue("bluechi_node.main", tfjsonpath.New("bluechi_agent").AtMapKey("rendered_config")),
+					},
+				},
+			},
+		},
+	})
+}
+
+func TestBlueChiNodeResourceImport(t *testing.T) {
+	resource.Test(t, resource.TestCase{
+		PreCheck:                 func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: validationConfig("bluechi_agent", `node_name = "main"`),
+			},
+			{
+				ResourceName:     "bluechi_node.main",
+				ImportState:      true,
+				ImportStateId:    "127.0.0.1:2020/main",
+				ImportStateCheck: importedNodeCheck("127.0.0.1:2020/main", "127.0.0.1:2020", "main"),
+			},
+			{
+				ResourceName:     "bluechi_node.main",
+				ImportState:      true,
+				ImportStateId:    "127.0.0.1:2020/@controller",
+				ImportStateCheck: importedNodeCheck("127.0.0.1:2020/@controller", "127.0.0.1:2020", ""),
+			},
+			{
+				ResourceName:  "bluechi_node.main",
+				ImportState:   true,
+				ImportStateId: "127.0.0.1:2020",
+				ExpectError:   regexp.MustCompile(`expected an id of the form`),
+			},
+			{
+				ResourceName:  "bluechi_node.main",
+				ImportState:   true,
+				ImportStateId: "127.0.0.1:2020/",
+				ExpectError:   regexp.MustCompile(`expected an id of the form`),
+			},
+			{
+				ResourceName:  "bluechi_node.main",
+				ImportState:   true,
+				ImportStateId: "127.0.0.1:2020/worker 1",
+				ExpectError:   regexp.MustCompile(`got: worker 1`),
+			},
+		},
+	})
+}
+
+// TestBlueChiNodeResourceImportIdentity imports through the provider server,
+// since import blocks expect a plan without changes, while an imported node
+// only gets its connection details from the config by the next apply.
+func TestBlueChiNodeResourceImportIdentity(t *testing.T) {
+	ctx := context.Background()
+	server, err := testAccProtoV6ProviderFactories["bluechi"]()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identitySchemas, err := server.(tfprotov6.ProviderServerWithResourceIdentity).GetResourceIdentitySchemas(ctx, &tfprotov6.GetResourceIdentitySchemasRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityType := identitySchemas.IdentitySchemas["bluechi_node"].ValueType()
+	providerSchema, err := server.GetProviderSchema(ctx, &tfprotov6.GetProviderSchemaRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateType := providerSchema.ResourceSchemas["bluechi_node"].ValueType()
+
+	tests := map[string]*string{
+		"127.0.0.1:2020/main":        stringPointer("main"),
+		"127.0.0.1:2020/@controller": nil,
+	}
+	for expectedID, nodeName := range tests {
+		identity, err := tfprotov6.NewDynamicValue(identityType, tftypes.NewValue(identityType, map[string]tftypes.Value{
+			"host":      tftypes.NewValue(tftypes.String, "127.0.0.1:2020"),
+			"node_name": tftypes.NewValue(tftypes.String, nodeName),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := server.ImportResourceState(ctx, &tfprotov6.ImportResourceStateRequest{
+			TypeName: "bluechi_node",
+			Identity: &tfprotov6.ResourceIdentityData{IdentityData: &identity},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Diagnostics) > 0 || len(resp.ImportedResources) != 1 {
+			t.Fatalf("expected one imported node for %s, got %d and diagnostics %v", expectedID, len(resp.ImportedResources), resp.Diagnostics)
+		}
+
+		state, err := resp.ImportedResources[0].State.Unmarshal(stateType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for attributePath, expected := range map[*tftypes.AttributePath]*string{
+			tftypes.NewAttributePath().WithAttributeName("id"):                                           &expectedID,
+			tftypes.NewAttributePath().WithAttributeName("ssh").WithAttributeName("host"):                stringPointer("127.0.0.1:2020"),
+			tftypes.NewAttributePath().WithAttributeName("bluechi_agent").WithAttributeName("node_name"): nodeName,
+		} {
+			value, _, err := tftypes.WalkAttributePath(state, attributePath)
+			if err != nil && expected != nil {
+				t.Fatalf("expected %s in the state of %s: %s", attributePath, expectedID, err)
+			}
+			var actual *string
+			if err == nil {
+				if err := value.(tftypes.Value).As(&actual); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if (actual == nil) != (expected == nil) || (actual != nil && *actual != *expected) {
+				t.Errorf("expected %s of %s to be %v, got %v", attributePath, expectedID, expected, actual)
+			}
+		}
+	}
+
+	invalid, err := tfprotov6.NewDynamicValue(identityType, tftypes.NewValue(identityType, map[string]tftypes.Value{
+		"host":      tftypes.NewValue(tftypes.String, "127.0.0.1:2020"),
+		"node_name": tftypes.NewValue(tftypes.String, "worker 1"),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.ImportResourceState(ctx, &tfprotov6.ImportResourceStateRequest{
+		TypeName: "bluechi_node",
+		Identity: &tfprotov6.ResourceIdentityData{IdentityData: &invalid},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Diagnostics) == 0 {
+		t.Errorf("expected an error for the invalid node name")
+	}
+}
+
+func TestBlueChiNodeResourceDestroyOptions(t *testing.T) {
+	// the mock is replaced by a client which can't connect, so the update
+	// fails if it connects to the machine
+	unreachable := func(block string, attributes string) string {
+		return strings.Replace(validationConfig(block, attributes), "use_mock = true", "use_mock = false", 1)
+	}
+
+	resource.Test(t, resource.TestCase{
+		PreCheck:                 func() { testAccPreCheck(t) },
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		AdditionalCLIOptions: &resource.AdditionalCLIOptions{
+			Plan: resource.PlanOptions{NoRefresh: true},
+		},
+		Steps: []resource.TestStep{
+			{
+				Config: validationConfig("", ""),
+			},
+			{
+				Config: unreachable("", `force_destroy = true
+				uninstall_on_destroy = true`),
+				ConfigStateChecks: []statecheck.StateCheck{
+					statecheck.ExpectKnownValue("bluechi_node.main", tfjsonpath.New("force_destroy"), knownvalue.Bool(true)),
+					statecheck.ExpectKnownValue("bluechi_node.main", tfjsonpath.New("uninstall_on_destroy"), knownvalue.Bool(true)),
+				},
+			},
+			{
+				Config:      unreachable("bluechi_controller", `log_level = "DEBUG"`),
+				ExpectError: regexp.MustCompile(`Failed to connect`),
+			},
+		},
+	})
+}
+
+func importedNodeCheck(id string, host string, nodeName string) resource.ImportStateCheckFunc {
+	return func(states []*terraform.InstanceState) error {
+		if len(states) != 1 {
+			return fmt.Errorf("expected one imported node, got %d", len(states))
+		}
+		attributes := states[0].Attributes
+		if states[0].ID != id {
+			return fmt.Errorf("expected id %s, got %s", id, states[0].ID)
+		}
+		if attributes["ssh.host"] != host {
+			return fmt.Errorf("expected host %s, got %s", host, attributes["ssh.host"])
+		}
+		if attributes["bluechi_agent.node_name"] != nodeName {
+			return fmt.Errorf("expected node name '%s', got '%s'", nodeName, attributes["bluechi_agent.node_name"])
+		}
+		return nil
+	}
+}
+
+func stringPointer(value string) *string {
+	return &value
+}
+
+// validationConfig renders a node with the attributes of the given block
+// replaced, which are ssh, bluechi_controller, bluechi_agent and
+// package_source. Any other block name adds the attributes to the resource.
+func validationConfig(block string, attributes string) string {
+	blocks := map[string]string{
+		"ssh":                `private_key_path = "~/.ssh/id_rsa"`,
+		"bluechi_controller": "",
+		"bluechi_agent":      `node_name = "main"`,
+	}
+	resourceAttributes := ""
+	if _, ok := blocks[block]; ok {
+		blocks[block] = attributes
+	} else if block == "package_source" {
+		resourceAttributes = fmt.Sprintf("package_source = {\n\t\t%s\n\t}", attributes)
+	} else {
+		resourceAttributes = attributes
+	}
+
+	return fmt.Sprintf(`
+provider "bluechi" {
+	use_mock = true
+}
+
+resource "bluechi_node" "main" {
+	ssh = {
+		host = "127.0.0.1:2020"
+		user = "root"
+		%s
+	}
+
+	bluechi_controller = {
+		allowed_node_names = ["main"]
+		%s
+	}
+
+	bluechi_agent = {
+		manager_host = "127.0.0.1"
+		%s
+	}
+
+	%s
+}
+`, blocks["ssh"], blocks["bluechi_controller"], blocks["bluechi_agent"], resourceAttributes)
+}
+
 func exampleConfig() string {
 	return `
 provider "bluechi" {
@@ -30,7 +387,6 @@ resource "bluechi_node" "main" {
 	ssh = {
 		host             	       = "127.0.0.1:2020"
 		user             	       = "root"
-		password         	       = ""
 		private_key_path 	       = "~/.ssh/id_rsa"
 		accept_host_key_insecure   = true
 	}
@@ -49,7 +405,6 @@ resource "bluechi_node" "main" {
 		node_name			= "main"
 		manager_host		= "127.0.0.1"
 		manager_port		= 3030
-		manager_address		= ""
 		heartbeat_interval	= 5000
 		log_level			= "DEBUG"
 		log_target			= "stderr-full"
@@ -62,7 +417,6 @@ resource "bluechi_node" "worker1" {
 	ssh = {
 		host                    	= "127.0.0.1:2021"
 		user                    	= "root"
-		password                	= ""
 		private_key_path        	= "~/.ssh/id_rsa"
 		accept_host_key_insecure   = true
 	}
@@ -71,7 +425,6 @@ resource "bluechi_node" "worker1" {
 		node_name			= "worker1"
 		manager_host		= "127.0.0.1"
 		manager_port		= 3030
-		manager_address		= ""
 		heartbeat_interval	= 5000
 		log_level			= "DEBUG"
 		log_target			= "stderr-full"
@@ -84,7 +437,6 @@ resource "bluechi_node" "worker2" {
 	ssh = {
 		host                	    = "127.0.0.1:2022"
 		user                	    = "root"
-		password            	    = ""
 		private_key_path    	    = "~/.ssh/id_rsa"
 		accept_host_key_insecure   = true
 	}
@@ -93,7 +445,6 @@ resource "bluechi_node" "worker2" {
 		node_name			= "worker2"
 		manager_host		= "127.0.0.1"
 		manager_port		= 3030
-		manager_address		= ""
 		heartbeat_interval	= 5000
 		log_level			= "DEBUG"
 		log_target			= "stderr-full"
@@ -106,7 +457,6 @@ resource "bluechi_node" "worker3" {
 	ssh = {
 		host                    	= "127.0.0.1:2023"
 		user                    	= "root"
-		password                	= ""
 		private_key_path        	= "~/.ssh/id_rsa"
 		accept_host_key_insecure    = true
 	}
@@ -115,7 +465,6 @@ resource "bluechi_node" "worker3" {
 		node_name			= "worker3"
 		manager_host		= "127.0.0.1"
 		manager_port		= 3030
-		manager_address		= ""
 		heartbeat_interval	= 5000
 		log_level			= "DEBUG"
 		log_target			= "stderr-full"